@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Linux/client/certificate.go
+// Peer certificates for Linux client build
+// Developer: CyberPanther232
+
+// A peer certificate lets a Burrow CA vouch for a client's static key, so a
+// server only needs the CA's public key instead of a list of every client.
+// The signed body is kept as the exact bytes that were signed, which spares
+// both sides from agreeing on a canonical encoding.
+const certificateVersion = 1
+
+// Certificate binds a client's Noise static key to the name, addresses and
+// groups the server should give it, for a limited time.
+type Certificate struct {
+	Version          int       `json:"version"`
+	PublicKey        string    `json:"public_key"` // hex client static key
+	Name             string    `json:"name"`
+	AllowedAddresses []string  `json:"allowed_addresses,omitempty"`
+	Groups           []string  `json:"groups,omitempty"`
+	NotBefore        time.Time `json:"not_before"`
+	NotAfter         time.Time `json:"not_after"`
+}
+
+// SignedCertificate is the form a certificate is stored and sent in.
+type SignedCertificate struct {
+	Body      []byte `json:"certificate"`
+	Signature []byte `json:"signature"`
+}
+
+// parseCertificate decodes a signed certificate without checking it.
+func parseCertificate(data []byte) (*SignedCertificate, *Certificate, error) {
+	var signed SignedCertificate
+	err := json.Unmarshal(data, &signed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	var cert Certificate
+	err = json.Unmarshal(signed.Body, &cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	if cert.Version != certificateVersion {
+		return nil, nil, fmt.Errorf("unsupported certificate version %d", cert.Version)
+	}
+	return &signed, &cert, nil
+}
+
+// loadCertificate reads a certificate file and checks that it is issued for
+// the given key, so a client notices a mismatch before connecting.
+func loadCertificate(path string, publicKey []byte) ([]byte, *Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, cert, err := parseCertificate(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate key: %w", err)
+	}
+	if !bytes.Equal(key, publicKey) {
+		return nil, nil, fmt.Errorf("certificate is issued for %s, not for this key", fingerprint(key))
+	}
+	return data, cert, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Linux/client/commands.go
+// Key management subcommands for Linux client build
+// Developer: CyberPanther232
+
+// runCommand handles the subcommands that manage key files instead of
+// starting the client, and returns the process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "genpsk":
+		key, err := generatePresharedKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate pre-shared key: %v\n", err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	case "rotatepsk":
+		if len(args) != 2 && len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: rotatepsk <key file> [key]")
+			return 2
+		}
+		var key string
+		if len(args) == 3 {
+			key = args[2]
+		}
+		// The client uses a new key right away; the server must have it
+		// already
+		key, err := rotatePresharedKey(args[1], key, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate pre-shared key: %v\n", err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	case "encryptkey", "decryptkey":
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s <private key file>\n", args[0])
+			return 2
+		}
+		err := convertKeyFile(args[1], args[0] == "encryptkey")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update %s: %v\n", args[1], err)
+			return 1
+		}
+		return 0
+	case "genkey", "pubkey", "fingerprint", "rotate":
+		if len(args) > 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s [private key file]\n", args[0])
+			return 2
+		}
+		path, encrypt, err := keyFileFromArgs(args)
+		if err == nil {
+			err = runKeyCommand(args[0], path, encrypt)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q (available: genkey, pubkey, fingerprint, rotate, genpsk, rotatepsk, encryptkey, decryptkey)\n", args[0])
+	return 2
+}
+
+// keyFileFromArgs returns the private key file named on the command line or,
+// without one, ClientKeyFile from the configuration, and whether new keys
+// are to be encrypted.
+func keyFileFromArgs(args []string) (string, bool, error) {
+	config, err := loadClientConfig("client_config.yml")
+	if len(args) == 2 {
+		return args[1], err == nil && config.EncryptPrivateKey, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("no key file given and client_config.yml could not be loaded: %w", err)
+	}
+	return config.ClientKeyFile, config.EncryptPrivateKey, nil
+}
+
+func runKeyCommand(command, path string, encrypt bool) error {
+	switch command {
+	case "genkey":
+		if fileExists(path) {
+			return fmt.Errorf("%s already exists; use rotate to replace it", path)
+		}
+		key, err := generateIdentity()
+		if err != nil {
+			return err
+		}
+		err = saveKey(path, key, encrypt)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%x\n", key.Public)
+	case "pubkey", "fingerprint":
+		key, err := loadKey(path)
+		if err != nil {
+			return err
+		}
+		if command == "pubkey" {
+			fmt.Printf("%x\n", key.Public)
+		} else {
+			fmt.Println(fingerprint(key.Public))
+		}
+	case "rotate":
+		key, err := rotateKeyFile(path, encrypt)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Previous key kept in %s; add the new key to the server's authorized peers\n", previousKeyPath(path))
+		fmt.Printf("%x\n", key.Public)
+	}
+	return nil
+}
+
+// convertKeyFile rewrites a private key file encrypted with a new passphrase,
+// or in the clear.
+func convertKeyFile(path string, encrypt bool) error {
+	priv, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	if len(priv) != 32 {
+		return errors.New("invalid private key length")
+	}
+	return writeKeyFile(path, priv, encrypt)
+}
@@ -1,5 +1,77 @@
 package main
 
+import (
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
 // Linux/client/connections.go
 // Connection handling functions for Linux client build
 // Developer: CyberPanther232
+
+// writeTUN hands a single packet to the TUN device, reserving the headroom the
+// platform driver expects in front of it.
+func writeTUN(dev tun.Device, packet []byte) error {
+	buf := make([]byte, tunOffset+len(packet))
+	copy(buf[tunOffset:], packet)
+	_, err := dev.Write([][]byte{buf}, tunOffset)
+	return err
+}
+
+// Tunnel is an established, encrypted connection to the server.
+type Tunnel struct {
+	conn    Transport
+	send    *sendState
+	recv    *recvState
+	monitor *peerMonitor
+
+	// Server static key and handshake hash the tunnel was set up with
+	serverKey      []byte
+	channelBinding []byte
+
+	sendMu    sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newTunnel(conn Transport, send *sendState, recv *recvState) *Tunnel {
+	return &Tunnel{
+		conn: conn,
+		send: send,
+		recv: recv,
+		done: make(chan struct{}),
+	}
+}
+
+// Send encrypts an IP packet and writes it to the server. It is safe to call
+// from multiple goroutines.
+func (t *Tunnel) Send(packet []byte) error {
+	return t.SendMessage(messageData, packet)
+}
+
+func (t *Tunnel) SendMessage(mt messageType, payload []byte) error {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+
+	encryptedPacket := encryptPacket(t.send, encodeMessage(mt, payload))
+	t.monitor.Sent()
+	return t.conn.Send(encryptedPacket)
+}
+
+// Disconnect tells the server why the tunnel is ending before closing it.
+func (t *Tunnel) Disconnect(reason string) {
+	t.SendMessage(messageClose, []byte(reason))
+	t.Close()
+}
+
+func (t *Tunnel) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.conn.Close()
+	})
+}
+
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
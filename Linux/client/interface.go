@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/netip"
+	"os/exec"
+	"strconv"
+)
+
+// Linux/client/interface.go
+// TUN interface helpers for Linux client build
+// Developer: CyberPanther232
+
+// Headroom the TUN driver expects in front of each packet handed to Write.
+// With offloads enabled the Linux driver writes a virtio-net header there.
+const tunOffset = 10
+
+// Room for the largest packet a read can return. With offloads enabled a
+// read may carry a segmentation offload packet of up to 64 KiB.
+const tunBufferSize = tunOffset + 65535
+
+// configureInterface gives the interface address as its only global address,
+// replacing any address left over from an earlier tunnel, and brings it up.
+func configureInterface(name string, address netip.Prefix) {
+	cmd := exec.Command("ip", "addr", "flush", "dev", name, "scope", "global")
+	cmd.Run()
+	cmd = exec.Command("ip", "addr", "add", address.String(), "dev", name)
+	cmd.Run()
+	cmd = exec.Command("ip", "link", "set", "dev", name, "up")
+	cmd.Run()
+}
+
+func setInterfaceMTU(name string, mtu int) {
+	cmd := exec.Command("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
+	cmd.Run()
+}
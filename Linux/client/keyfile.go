@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/term"
+)
+
+// Linux/client/keyfile.go
+// Private key file storage for Linux client build
+// Developer: CyberPanther232
+
+// A private key file holds either the raw 32-byte key or an encrypted key:
+//
+//	[magic 9 bytes][version 1][time 4][memory 4][threads 1][salt 16][nonce 24][sealed key 48]
+//
+// The key is sealed with XChaCha20-Poly1305 under a key derived from the
+// passphrase with argon2id, using the parameters in the header. The whole
+// header is authenticated, so the parameters cannot be weakened without
+// knowing the passphrase.
+const (
+	keyFileMagic     = "BURROWKEY"
+	keyFileVersion   = 1
+	keyFileSaltLen   = 16
+	keyFileHeaderLen = len(keyFileMagic) + 1 + 4 + 4 + 1 + keyFileSaltLen + chacha20poly1305.NonceSizeX
+)
+
+// argon2id parameters for newly encrypted keys, following RFC 9106's
+// recommendation for memory-constrained environments
+const (
+	keyFileTime    = 3
+	keyFileMemory  = 64 * 1024 // KiB
+	keyFileThreads = 4
+)
+
+// Limits on the parameters of a key file being decrypted, so a damaged or
+// hostile header cannot make the key derivation panic or exhaust memory
+// before the passphrase is even checked
+const (
+	keyFileMaxTime   = 64
+	keyFileMaxMemory = 1024 * 1024 // KiB
+)
+
+// Unattended services can pass the passphrase in the environment or through
+// an inherited file descriptor instead of answering a prompt.
+const (
+	passphraseEnv   = "BURROW_PASSPHRASE"
+	passphraseFDEnv = "BURROW_PASSPHRASE_FD"
+)
+
+func isEncryptedKey(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(keyFileMagic))
+}
+
+func encryptPrivateKey(priv, passphrase []byte) ([]byte, error) {
+	header := make([]byte, 0, keyFileHeaderLen)
+	header = append(header, keyFileMagic...)
+	header = append(header, keyFileVersion)
+	header = binary.BigEndian.AppendUint32(header, keyFileTime)
+	header = binary.BigEndian.AppendUint32(header, keyFileMemory)
+	header = append(header, keyFileThreads)
+	saltAndNonce := make([]byte, keyFileSaltLen+chacha20poly1305.NonceSizeX)
+	_, err := rand.Read(saltAndNonce)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, saltAndNonce...)
+
+	salt := saltAndNonce[:keyFileSaltLen]
+	nonce := saltAndNonce[keyFileSaltLen:]
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, keyFileTime, keyFileMemory, keyFileThreads, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, priv, header), nil
+}
+
+func decryptPrivateKey(data, passphrase []byte) ([]byte, error) {
+	if len(data) < keyFileHeaderLen {
+		return nil, errors.New("encrypted key file is truncated")
+	}
+	header := data[:keyFileHeaderLen]
+	rest := header[len(keyFileMagic):]
+	if rest[0] != keyFileVersion {
+		return nil, fmt.Errorf("unsupported key file version %d", rest[0])
+	}
+	passes := binary.BigEndian.Uint32(rest[1:5])
+	memory := binary.BigEndian.Uint32(rest[5:9])
+	threads := rest[9]
+	salt := rest[10 : 10+keyFileSaltLen]
+	nonce := rest[10+keyFileSaltLen:]
+	if passes == 0 || passes > keyFileMaxTime || memory == 0 || memory > keyFileMaxMemory || threads == 0 {
+		return nil, fmt.Errorf("key file has invalid argon2id parameters (time %d, memory %d KiB, threads %d)", passes, memory, threads)
+	}
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, passes, memory, threads, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	priv, err := aead.Open(nil, nonce, data[keyFileHeaderLen:], header)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted key file")
+	}
+	return priv, nil
+}
+
+// readKeyFile returns the private key stored at path, asking for the
+// passphrase if the file is encrypted.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncryptedKey(data) {
+		return data, nil
+	}
+	passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", path), false)
+	if err != nil {
+		return nil, err
+	}
+	return decryptPrivateKey(data, passphrase)
+}
+
+// writeKeyFile stores a private key at path, encrypted with a passphrase if
+// encrypt is set. The file is replaced atomically.
+func writeKeyFile(path string, priv []byte, encrypt bool) error {
+	data := priv
+	if encrypt {
+		passphrase, err := readPassphrase(fmt.Sprintf("New passphrase for %s: ", path), true)
+		if err != nil {
+			return err
+		}
+		data, err = encryptPrivateKey(priv, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// rotateKeyFile stores a new key at path and keeps the one it replaces at
+// previousKeyPath. A key prepared at nextKeyPath becomes the new key;
+// otherwise one is generated.
+func rotateKeyFile(path string, encrypt bool) (noise.DHKey, error) {
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	next, ok, err := loadNextKey(path)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+
+	previous := previousKeyPath(path)
+	err = os.WriteFile(previous+".tmp", old, 0600)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	err = os.Rename(previous+".tmp", previous)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	if ok {
+		return next, os.Rename(nextKeyPath(path), path)
+	}
+
+	key, err := generateIdentity()
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	return key, saveKey(path, key, encrypt || isEncryptedKey(old))
+}
+
+func previousKeyPath(path string) string {
+	return path + ".previous"
+}
+
+func nextKeyPath(path string) string {
+	return path + ".next"
+}
+
+// loadNextKey returns the key prepared for the next rotation, if there is one.
+func loadNextKey(path string) (noise.DHKey, bool, error) {
+	key, err := loadKey(nextKeyPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return noise.DHKey{}, false, nil
+	}
+	if err != nil {
+		return noise.DHKey{}, false, err
+	}
+	return key, true, nil
+}
+
+// fdPassphrase keeps the passphrase read from BURROW_PASSPHRASE_FD, which can
+// only be read once, for the next key file that needs it.
+var fdPassphrase []byte
+
+// readPassphrase takes the passphrase from the environment, from an inherited
+// file descriptor or from the terminal, in that order. A new passphrase is
+// asked for twice when it is typed in.
+func readPassphrase(prompt string, confirm bool) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(passphrase), nil
+	}
+	if fdPassphrase != nil {
+		return fdPassphrase, nil
+	}
+	if s, ok := os.LookupEnv(passphraseFDEnv); ok {
+		fd, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", passphraseFDEnv, err)
+		}
+		f := os.NewFile(uintptr(fd), "passphrase")
+		line, err := bufio.NewReader(f).ReadString('\n')
+		f.Close()
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("failed to read passphrase from descriptor %d: %w", fd, err)
+		}
+		fdPassphrase = []byte(strings.TrimRight(line, "\r\n"))
+		return fdPassphrase, nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, fmt.Errorf("a passphrase is needed: set %s or %s, or run from a terminal", passphraseEnv, passphraseFDEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Linux/client/known_servers.go
+// Server key pinning for Linux client build
+// Developer: CyberPanther232
+
+var errServerKeyMismatch = errors.New("server public key does not match the pinned key")
+
+// newServerVerifier returns the check run against the server's static key
+// after handshake message 2. The key must be pinned, either in the config or
+// in the known servers file, where the server's key announcements and, in
+// trust-on-first-use mode, the first key seen are recorded under the
+// server's address.
+func newServerVerifier(config *ClientConfig) (func(peerStatic []byte) error, error) {
+	if config.ServerPublicKey != "" {
+		_, err := parsePublicKey(config.ServerPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServerPublicKey: %w", err)
+		}
+	} else if !config.TrustOnFirstUse {
+		return nil, errors.New("no ServerPublicKey configured; set it or enable TrustOnFirstUse")
+	}
+
+	return func(peerStatic []byte) error {
+		known, err := knownServerKeys(config)
+		if err != nil {
+			return err
+		}
+		if known != nil {
+			return comparePinnedKeys(known, peerStatic)
+		}
+
+		host := serverHost(config)
+		log.Printf("Trusting new server %s with public key %x\n", host, peerStatic)
+		return addKnownServer(config.KnownServersFile, host, peerStatic)
+	}, nil
+}
+
+// knownServerKeys returns the server keys the client trusts, the one the
+// server last announced as current first, or nil if there are none yet.
+func knownServerKeys(config *ClientConfig) ([][]byte, error) {
+	known, err := lookupKnownServer(config.KnownServersFile, serverHost(config))
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerPublicKey != "" {
+		pinned, err := parsePublicKey(config.ServerPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if !containsKey(known, pinned) {
+			known = append(known, pinned)
+		}
+	}
+	return known, nil
+}
+
+func serverHost(config *ClientConfig) string {
+	return fmt.Sprintf("%s:%d", config.ServerAddress, config.ServerPort)
+}
+
+func comparePinnedKeys(pinned [][]byte, peerStatic []byte) error {
+	if !containsKey(pinned, peerStatic) {
+		return fmt.Errorf("%w: expected %x, got %x", errServerKeyMismatch, pinned[0], peerStatic)
+	}
+	return nil
+}
+
+// updateServerKeys pins the keys a server announces over an established
+// tunnel, replacing the keys recorded for it before, so the client follows
+// the server through a key rotation.
+func (c *Client) updateServerKeys(tunnel *Tunnel, body json.RawMessage) error {
+	var announced ServerKeys
+	err := json.Unmarshal(body, &announced)
+	if err != nil {
+		return err
+	}
+	var keys [][]byte
+	for _, s := range []string{announced.Current, announced.Next} {
+		if s == "" {
+			continue
+		}
+		key, err := parsePublicKey(s)
+		if err != nil {
+			return fmt.Errorf("invalid server key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return errors.New("no current server key")
+	}
+
+	host := serverHost(c.config)
+	known, err := lookupKnownServer(c.config.KnownServersFile, host)
+	if err != nil {
+		return err
+	}
+	if slices.EqualFunc(known, keys, bytes.Equal) {
+		return nil
+	}
+	err = setKnownServer(c.config.KnownServersFile, host, keys)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pinned server key %x for %s\n", keys[0], host)
+	if len(keys) > 1 {
+		log.Printf("Pinned next server key %x for %s\n", keys[1], host)
+	}
+	if c.config.ServerPublicKey != "" {
+		pinned, err := parsePublicKey(c.config.ServerPublicKey)
+		if err == nil && !bytes.Equal(pinned, keys[0]) {
+			log.Println("ServerPublicKey in client_config.yml is no longer the server's current key")
+		}
+	}
+	return nil
+}
+
+// lookupKnownServer returns the recorded keys for host, or nil if the host
+// has never been seen. Each line of the file is "host:port key", and a host
+// may have several lines; lines starting with # are ignored.
+func lookupKnownServer(path, host string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != host {
+			continue
+		}
+		key, err := parsePublicKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for %s in %s: %w", host, path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+func addKnownServer(path, host string, key []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s %x\n", host, key)
+	return err
+}
+
+// setKnownServer replaces the keys recorded for host, keeping every other
+// line of the file. The file is replaced atomically.
+func setKnownServer(path, host string, keys [][]byte) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Fields(line)
+		if line == "" || len(fields) == 2 && fields[0] == host {
+			continue
+		}
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&out, "%s %x\n", host, key)
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, []byte(out.String()), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
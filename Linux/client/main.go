@@ -1,11 +1,9 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"log"
-	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"syscall"
 
@@ -13,97 +11,56 @@ import (
 )
 
 func main() {
-	// 1. Create the TUN interface
-	dev, err := tun.CreateTUN("BurrowClient", 1500)
-	if err != nil {
-		log.Fatal(err)
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
 	}
-	defer dev.Close()
 
 	config, err := loadClientConfig("client_config.yml")
 	if err != nil {
 		log.Fatalf("Failed to load client configuration: %v", err)
 	}
 
-	// 2. Connect to the Server via TCP
-	conn, err := net.Dial("tcp", config.ServerAddress+":"+fmt.Sprint(config.ServerPort))
+	// 1. Create the TUN interface
+	dev, err := tun.CreateTUN("BurrowClient", config.MTU)
 	if err != nil {
-		log.Fatalf("Failed to connect to server: %v", err)
+		log.Fatal(err)
 	}
-	defer conn.Close()
-	log.Println("Connected to server")
+	defer dev.Close()
 
-	clientKey, err := generateIdentity()
+	verifyServer, err := newServerVerifier(config)
 	if err != nil {
-		log.Fatalf("Failed to generate client key: %v", err)
+		log.Fatalf("Failed to configure server authentication: %v", err)
 	}
 
-	sendCipher, recvCipher, err := runClientHandshake(conn, clientKey)
+	clientKey, err := loadKey(config.ClientKeyFile)
 	if err != nil {
-		log.Fatalf("Handshake failed: %v", err)
-	}
-
-	// 3. Bring the interface up
-	cmd := exec.Command("ip", "addr", "add", "10.0.0.2/24", "dev", "BurrowClient")
-	cmd.Run()
-	cmd = exec.Command("ip", "link", "set", "dev", "BurrowClient", "up")
-	cmd.Run()
-
-	// 4. Start the Upstream Loop (TUN -> TCP)
-	go func() {
-		packets := make([][]byte, 1)
-		packets[0] = make([]byte, 1500)
-		sizes := make([]int, 1)
-		for {
-			n, err := dev.Read(packets, sizes, 0)
-			if err != nil {
-				log.Printf("Upstream: Error reading from TUN device: %v", err)
-				continue
-			}
-			for i := 0; i < n; i++ {
-				packetData := packets[i][:sizes[i]]
-				if len(packetData) == 0 {
-					continue
-				}
-				log.Printf("Upstream: Raw packet: %d bytes\n", len(packetData))
-
-				encryptedPacket := encryptPacket(recvCipher, packetData)
-				log.Printf("Upstream: Encrypted packet: %d bytes\n", len(encryptedPacket))
-
-				err = sendFramed(conn, encryptedPacket)
-				if err != nil {
-					log.Printf("Upstream: Failed to write to TCP: %v", err)
-				}
-			}
+		// Never replace a key that exists but could not be read
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("Failed to load client key: %v", err)
 		}
-	}()
-
-	// 5. Start the Downstream Loop (TCP -> TUN)
-	go func() {
-		for {
-			ciphertext, err := readFramed(conn)
-			if err != nil {
-				log.Printf("Downstream: Error reading from TCP: %v", err)
-				return
-			}
-			log.Printf("Downstream: Received %d bytes\n", len(ciphertext))
-
-			decryptedPacket, err := decryptPacket(sendCipher, ciphertext)
-			if err != nil {
-				log.Fatalf("Downstream: Failed to decrypt packet: %v", err)
-			}
-			log.Printf("Downstream: Decrypted packet: %d bytes\n", len(decryptedPacket))
-
-			// Write the data received from the server back into our local OS
-			_, err = dev.Write([][]byte{decryptedPacket}, 0)
-			if err != nil {
-				log.Printf("Downstream: Error writing to TUN device: %v", err)
-			}
+		log.Println("No key file found, generating a new one...")
+		clientKey, err = generateIdentity()
+		if err != nil {
+			log.Fatalf("Failed to generate client key: %v", err)
 		}
-	}()
+		err = saveKey(config.ClientKeyFile, clientKey, config.EncryptPrivateKey)
+		if err != nil {
+			log.Fatalf("Failed to save client key: %v", err)
+		}
+	}
+	log.Printf("Client public key: %x (%s)\n", clientKey.Public, fingerprint(clientKey.Public))
+
+	// 2. Connect to the server, bring the interface up with the leased
+	// address and keep reconnecting whenever the tunnel is lost
+	client, err := newClient(config, dev, clientKey, verifyServer)
+	if err != nil {
+		log.Fatalf("Failed to configure client: %v", err)
+	}
+	go client.Run()
 
 	// Keep alive until Ctrl+C
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	<-stop
+	client.Close()
 }
@@ -0,0 +1,50 @@
+package main
+
+// Linux/client/replay.go
+// Replay protection for Linux client build
+// Developer: CyberPanther232
+
+const (
+	replayBlockBits = 64
+	replayBlocks    = 32
+
+	// Packets older than this many counters behind the newest one are
+	// rejected; anything newer may arrive in any order, but only once.
+	replayWindowSize = (replayBlocks - 1) * replayBlockBits
+)
+
+// replayWindow is a sliding bitmap over received packet counters (RFC 6479).
+// It is not safe for concurrent use; each receive loop owns its window.
+type replayWindow struct {
+	highest uint64
+	bitmap  [replayBlocks]uint64
+}
+
+// Check reports whether counter has not been seen and is still inside the
+// window. It does not record the counter; call Accept once the packet has
+// been authenticated.
+func (w *replayWindow) Check(counter uint64) bool {
+	if counter > w.highest {
+		return true
+	}
+	if w.highest-counter >= replayWindowSize {
+		return false
+	}
+	block := (counter / replayBlockBits) % replayBlocks
+	bit := uint64(1) << (counter % replayBlockBits)
+	return w.bitmap[block]&bit == 0
+}
+
+func (w *replayWindow) Accept(counter uint64) {
+	if counter > w.highest {
+		current := w.highest / replayBlockBits
+		next := counter / replayBlockBits
+		// Clear the blocks the window slides over
+		for i := current + 1; i <= next && i-current <= replayBlocks; i++ {
+			w.bitmap[i%replayBlocks] = 0
+		}
+		w.highest = counter
+	}
+	block := (counter / replayBlockBits) % replayBlocks
+	w.bitmap[block] |= uint64(1) << (counter % replayBlockBits)
+}
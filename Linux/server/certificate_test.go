@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Linux/server/certificate_test.go
+// Peer certificate and revocation tests for Linux server build
+// Developer: CyberPanther232
+
+func testCAKey(t *testing.T, seed byte) ed25519.PrivateKey {
+	t.Helper()
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	ca := testCAKey(t, 1)
+	otherCA := testCAKey(t, 2)
+	clientKey := bytes.Repeat([]byte{0xaa}, 32)
+	otherKey := bytes.Repeat([]byte{0xbb}, 32)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	newCert := func() *Certificate {
+		return &Certificate{
+			Version:          certificateVersion,
+			PublicKey:        hex.EncodeToString(clientKey),
+			Name:             "laptop",
+			AllowedAddresses: []string{"10.8.0.9"},
+			NotBefore:        now.Add(-time.Hour),
+			NotAfter:         now.Add(time.Hour),
+		}
+	}
+	sign := func(t *testing.T, cert *Certificate, key ed25519.PrivateKey) []byte {
+		t.Helper()
+		data, err := signCertificate(cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		data    func(t *testing.T) []byte
+		cas     []ed25519.PublicKey
+		peer    []byte
+		wantErr string
+	}{
+		{
+			name: "valid",
+			data: func(t *testing.T) []byte { return sign(t, newCert(), ca) },
+			cas:  []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)},
+			peer: clientKey,
+		},
+		{
+			name: "signed by the second trusted CA",
+			data: func(t *testing.T) []byte { return sign(t, newCert(), ca) },
+			cas:  []ed25519.PublicKey{otherCA.Public().(ed25519.PublicKey), ca.Public().(ed25519.PublicKey)},
+			peer: clientKey,
+		},
+		{
+			name:    "untrusted CA",
+			data:    func(t *testing.T) []byte { return sign(t, newCert(), otherCA) },
+			cas:     []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)},
+			peer:    clientKey,
+			wantErr: "not signed by a trusted CA",
+		},
+		{
+			name:    "no trusted CAs",
+			data:    func(t *testing.T) []byte { return sign(t, newCert(), ca) },
+			peer:    clientKey,
+			wantErr: "not signed by a trusted CA",
+		},
+		{
+			name:    "different key",
+			data:    func(t *testing.T) []byte { return sign(t, newCert(), ca) },
+			cas:     []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)},
+			peer:    otherKey,
+			wantErr: "issued for a different key",
+		},
+		{
+			name: "not yet valid",
+			data: func(t *testing.T) []byte {
+				cert := newCert()
+				cert.NotBefore = now.Add(time.Minute)
+				return sign(t, cert, ca)
+			},
+			cas:     []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)},
+			peer:    clientKey,
+			wantErr: "not valid before",
+		},
+		{
+			name: "expired",
+			data: func(t *testing.T) []byte {
+				cert := newCert()
+				cert.NotAfter = now.Add(-time.Minute)
+				return sign(t, cert, ca)
+			},
+			cas:     []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)},
+			peer:    clientKey,
+			wantErr: "expired",
+		},
+		{
+			name: "unsupported version",
+			data: func(t *testing.T) []byte {
+				cert := newCert()
+				cert.Version = certificateVersion + 1
+				return sign(t, cert, ca)
+			},
+			cas:     []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)},
+			peer:    clientKey,
+			wantErr: "unsupported certificate version",
+		},
+		{
+			name: "body changed after signing",
+			data: func(t *testing.T) []byte {
+				var signed SignedCertificate
+				if err := json.Unmarshal(sign(t, newCert(), ca), &signed); err != nil {
+					t.Fatal(err)
+				}
+				signed.Body = bytes.Replace(signed.Body, []byte("10.8.0.9"), []byte("10.8.0.1"), 1)
+				data, _ := json.Marshal(&signed)
+				return data
+			},
+			cas:     []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)},
+			peer:    clientKey,
+			wantErr: "not signed by a trusted CA",
+		},
+		{
+			name:    "not a certificate",
+			data:    func(t *testing.T) []byte { return []byte("not json") },
+			cas:     []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)},
+			peer:    clientKey,
+			wantErr: "invalid certificate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := verifyCertificate(tt.data(t), tt.cas, tt.peer, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Name != "laptop" || len(cert.AllowedAddresses) != 1 || cert.AllowedAddresses[0] != "10.8.0.9" {
+				t.Errorf("got certificate %+v", cert)
+			}
+		})
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/flynn/noise"
 )
@@ -14,98 +21,404 @@ import (
 // Cryptography functions for Linux server build
 // Developer: CyberPanther232
 
-var suite = noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+const packetHeaderLen = 12 // 4-byte key epoch + 8-byte counter
+
+var errReplayedPacket = errors.New("replayed or out-of-window packet")
 
 func generateIdentity() (noise.DHKey, error) {
-	return suite.GenerateKeypair(nil)
+	return noise.DH25519.GenerateKeypair(nil)
 }
 
-func sendFramed(conn net.Conn, data []byte) error {
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
-	_, err := conn.Write(lenBuf)
-	if err != nil {
-		return err
+// parsePublicKey accepts a 32-byte Curve25519 public key in hex or base64.
+func parsePublicKey(s string) ([]byte, error) {
+	key, ok := decodeKey(s)
+	if !ok {
+		return nil, errors.New("public key must be 32 bytes encoded as hex or base64")
 	}
-	_, err = conn.Write(data)
-	return err
+	return key, nil
 }
 
-func readFramed(conn net.Conn) ([]byte, error) {
-	lenBuf := make([]byte, 4)
-	_, err := io.ReadFull(conn, lenBuf)
-	if err != nil {
-		return nil, err
+// decodeKey decodes a 32-byte key written as hex or any common base64 form.
+func decodeKey(s string) ([]byte, bool) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, true
 	}
-	length := binary.BigEndian.Uint32(lenBuf)
-	data := make([]byte, length)
-	_, err = io.ReadFull(conn, data)
-	if err != nil {
-		return nil, err
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(s); err == nil && len(key) == 32 {
+			return key, true
+		}
 	}
-	return data, nil
+	return nil, false
+}
+
+// fingerprint is a short, printable identifier for a public key.
+func fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// handshakeOptions is what the server accepts from clients. For psk patterns,
+// PresharedKeys returns the keys a client may use, or every configured key
+// while the client is unknown, of which at most PresharedKeyTries are tried
+// unless it is negative. With Hybrid set, clients must add ML-KEM-768
+// to the handshake. Guard, if set, screens the first message before any
+// work is done on it, and the whole handshake must finish within Timeout.
+type handshakeOptions struct {
+	Patterns          []*handshakePattern
+	CipherSuites      []*cipherSuite
+	Hybrid            bool
+	PresharedKeys     func(peerStatic []byte) [][]byte
+	PresharedKeyTries int
+	Guard             *handshakeGuard
+	Timeout           time.Duration
+	Transport         string // hashed into the prologue
 }
 
-func runServerHandshake(conn net.Conn, serverKey noise.DHKey) (*noise.CipherState, *noise.CipherState, error) {
-	hs, err := noise.NewHandshakeState(noise.Config{
-		CipherSuite:   suite,
-		Random:        nil,
-		Pattern:       noise.HandshakeXX,
-		Initiator:     false,
-		StaticKeypair: serverKey,
-	})
+// runServerHandshake performs the responder side of the handshake in any of
+// the accepted modes. Once the client's static key and hello are known,
+// onPeer is told the mode the client chose and asked for the reply payload.
+// The reply rides in the server's last handshake message when the pattern
+// ends with one (IK) and is otherwise sent encrypted under the new session
+// keys (XX only reveals the client's key in its final message). A hybrid
+// handshake always sends the reply under the hybrid session keys. serverKeys
+// holds the current key first, followed by any other key clients may still
+// expect. The handshake hash is returned along with the session keys.
+func runServerHandshake(conn Transport, serverKeys []noise.DHKey, opts handshakeOptions, onPeer func(mode handshakeMode, peerStatic, hello []byte) ([]byte, error)) (*sendState, *recvState, []byte, error) {
+	// Datagrams can be lost and clients can stall on purpose, so never wait
+	// on a handshake forever
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// 1. Read the client's first message and check which mode it speaks
+	if opts.Guard != nil {
+		leave, ok := opts.Guard.Enter(conn.RemoteAddr())
+		if !ok {
+			return nil, nil, nil, errHandshakeThrottled
+		}
+		defer leave()
+	}
+	frame, err := conn.Receive()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create handshake state: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to read handshake message 1: %w", err)
+	}
+	if len(frame) == 0 {
+		return nil, nil, nil, errors.New("empty handshake message 1")
+	}
+	if opts.Guard != nil {
+		err = opts.Guard.Admit(conn.RemoteAddr())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer opts.Guard.Begin()()
 	}
+	id := frame[0]
+	mode, ok := parseHandshakeMode(id)
+	if !ok || !slices.Contains(opts.Patterns, mode.Pattern) || !slices.Contains(opts.CipherSuites, mode.Suite) || mode.Hybrid != opts.Hybrid {
+		refuseHandshake(conn, opts.Patterns, opts.CipherSuites, opts.Hybrid)
+		return nil, nil, nil, fmt.Errorf("client uses %s, which is not accepted", handshakeModeName(id))
+	}
+	log.Printf("Received handshake message 1 from client: %d bytes (%s)\n", len(frame), mode)
+	pattern, hybrid := mode.Pattern, mode.Hybrid
 
-	// 1. Read the client's first message (e)
-	msg, err := readFramed(conn)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read handshake message 1: %w", err)
+	// 2. Run the rest of the pattern. Even messages come from the client and
+	// the last of them carries its hello
+	messages := len(pattern.Pattern.Messages)
+	lastFromClient := (messages - 1) &^ 1
+	pskMessage := pattern.PSKPlacement - 1
+	replyInHandshake := lastFromClient != messages-1 && !hybrid
+	msg := frame[1:]
+	var transcript *handshakeTranscript
+	var hs *noise.HandshakeState
+	var reply, kemCiphertext, kemSecret []byte
+	var sendCipher, recvCipher *noise.CipherState
+	for i := 0; i < messages; i++ {
+		if i%2 == 0 {
+			if i > 0 {
+				msg, err = receiveHandshake(conn, id)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("failed to read handshake message %d: %w", i+1, err)
+				}
+				log.Printf("Received handshake message %d from client: %d bytes\n", i+1, len(msg))
+			}
+			var payload []byte
+			var cs1, cs2 *noise.CipherState
+			switch {
+			case i == 0:
+				transcript, hs, payload, err = readFirstMessage(mode, opts.Transport, serverKeys, msg)
+			case i == pskMessage:
+				// The message may reveal the client only along with its
+				// key, so check afterwards that the key is the client's own
+				var used []byte
+				hs, payload, cs1, cs2, used, err = transcript.readWithPSK(msg, opts.PresharedKeys(hs.PeerStatic()), opts.PresharedKeyTries)
+				if err == nil && !containsKey(opts.PresharedKeys(hs.PeerStatic()), used) {
+					err = errors.New("pre-shared key is not configured for this client")
+				}
+			default:
+				payload, cs1, cs2, err = hs.ReadMessage(nil, msg)
+				if err != nil {
+					err = readHandshakeError(err)
+				}
+			}
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to process handshake message %d: %w", i+1, err)
+			}
+			transcript.read(msg)
+			sendCipher, recvCipher = cs1, cs2
+			if hybrid && i == 0 {
+				var encapsulationKey []byte
+				encapsulationKey, payload, err = splitKEM(payload, mlkem.EncapsulationKeySize768)
+				if err == nil {
+					kemCiphertext, kemSecret, err = encapsulateKEM(encapsulationKey)
+				}
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("failed to process handshake message %d: %w", i+1, err)
+				}
+			}
+			if i == lastFromClient {
+				reply, err = onPeer(mode, hs.PeerStatic(), payload)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("client rejected: %w", err)
+				}
+			}
+		} else {
+			var payload []byte
+			if i == 1 && hybrid {
+				payload = append(payload, kemCiphertext...)
+			}
+			if i == messages-1 && replyInHandshake {
+				payload = append(payload, reply...)
+			}
+			if i == pskMessage {
+				keys := opts.PresharedKeys(hs.PeerStatic())
+				if len(keys) == 0 {
+					return nil, nil, nil, errors.New("no pre-shared key configured for this client")
+				}
+				hs.SetPresharedKey(keys[0])
+			}
+			msg, cs1, cs2, err := hs.WriteMessage(nil, payload)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to write handshake message %d: %w", i+1, err)
+			}
+			transcript.wrote(payload)
+			sendCipher, recvCipher = cs1, cs2
+			log.Printf("Sending handshake message %d to client: %d bytes\n", i+1, len(msg))
+			err = sendHandshake(conn, id, msg)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to send handshake message %d: %w", i+1, err)
+			}
+		}
 	}
-	log.Printf("Received handshake message 1 from client: %d bytes\n", len(msg))
-	_, _, _, err = hs.ReadMessage(nil, msg)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to process handshake message 1: %w", err)
+	if hybrid {
+		sendCipher, err = mixKEMSecret(mode.Suite.Suite, sendCipher, kemSecret, hs.ChannelBinding())
+		if err == nil {
+			recvCipher, err = mixKEMSecret(mode.Suite.Suite, recvCipher, kemSecret, hs.ChannelBinding())
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to mix in ML-KEM secret: %w", err)
+		}
 	}
+	send, recv := newSendState(sendCipher), newRecvState(mode.Suite.Suite, recvCipher)
 
-	// 2. Write the second message (e, ee, s, es)
-	msg, _, _, err = hs.WriteMessage(nil, nil)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to write handshake message 2: %w", err)
+	// 3. Unless it rode in the last handshake message, send the reply under
+	// the session keys
+	if !replyInHandshake {
+		log.Printf("Sending handshake reply to client: %d bytes\n", len(reply))
+		err = conn.Send(encryptPacket(send, reply))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to send handshake reply: %w", err)
+		}
 	}
-	log.Printf("Sending handshake message 2 to client: %d bytes\n", len(msg))
-	err = sendFramed(conn, msg)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to send handshake message 2: %w", err)
+
+	return send, recv, hs.ChannelBinding(), nil
+}
+
+// readFirstMessage reads the client's first message with the server key it is
+// meant for. IK clients encrypt it to the key they know, so each key is tried
+// in turn. XX clients may end the payload with a hint naming the key they
+// have pinned, and are otherwise answered with the current key.
+func readFirstMessage(mode handshakeMode, transport string, serverKeys []noise.DHKey, msg []byte) (*handshakeTranscript, *noise.HandshakeState, []byte, error) {
+	candidates := serverKeys
+	kemLen := 0
+	if mode.Hybrid {
+		kemLen = mlkem.EncapsulationKeySize768
+	}
+	hinted := false
+	if !mode.Pattern.KnowsResponder() {
+		// The first XX message does not involve the server key, so any key
+		// reads it well enough to find the hint
+		_, _, payload, err := readFirstMessageWith(mode, transport, serverKeys[0], msg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		candidates = serverKeys[:1]
+		if len(payload) == kemLen+keyHintLen {
+			hinted = true
+			for _, key := range serverKeys {
+				if bytes.Equal(keyHint(key.Public), payload[kemLen:]) {
+					candidates = []noise.DHKey{key}
+				}
+			}
+		}
 	}
 
-	// 3. Read the third message (s, se)
-	msg, err = readFramed(conn)
+	for _, key := range candidates {
+		transcript, hs, payload, err := readFirstMessageWith(mode, transport, key, msg)
+		if err != nil {
+			continue
+		}
+		if hinted {
+			payload = payload[:kemLen]
+		}
+		return transcript, hs, payload, nil
+	}
+	// An IK message for one of our keys fails just the same under another
+	// prologue
+	return nil, nil, nil, fmt.Errorf("message is not meant for any server key, or %w", errPrologueMismatch)
+}
+
+func readFirstMessageWith(mode handshakeMode, transport string, serverKey noise.DHKey, msg []byte) (*handshakeTranscript, *noise.HandshakeState, []byte, error) {
+	transcript, err := newHandshakeTranscript(mode.noiseConfig(false, serverKey, transport))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hs, err := transcript.start(nil)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read handshake message 3: %w", err)
+		return nil, nil, nil, err
 	}
-	log.Printf("Received handshake message 3 from client: %d bytes\n", len(msg))
-	_, sendCipher, recvCipher, err := hs.ReadMessage(nil, msg)
+	payload, _, _, err := hs.ReadMessage(nil, msg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to process handshake message 3: %w", err)
+		return nil, nil, nil, err
 	}
+	return transcript, hs, payload, nil
+}
+
+const (
+	defaultRekeyInterval = 2 * time.Minute
+	defaultRekeyBytes    = 1 << 30
+)
+
+// rekeyPolicy decides when a sender moves its direction of the session to the
+// next key. Zero values disable the corresponding trigger.
+type rekeyPolicy struct {
+	Interval time.Duration
+	Bytes    uint64
+}
+
+// newRekeyPolicy builds a policy from configuration values, where anything
+// not positive turns the trigger off.
+func newRekeyPolicy(interval time.Duration, bytes int64) rekeyPolicy {
+	var policy rekeyPolicy
+	if interval > 0 {
+		policy.Interval = interval
+	}
+	if bytes > 0 {
+		policy.Bytes = uint64(bytes)
+	}
+	return policy
+}
+
+// sendState is the sending half of a session. Every packet is prefixed with a
+// header of the key epoch and the 64-bit counter used as the AEAD nonce, so
+// the receiver can decrypt packets independently of their arrival order.
+type sendState struct {
+	cs        *noise.CipherState
+	epoch     uint32
+	bytes     uint64
+	rekeyedAt time.Time
+	policy    rekeyPolicy
+}
+
+func newSendState(cs *noise.CipherState) *sendState {
+	return &sendState{cs: cs, rekeyedAt: time.Now()}
+}
+
+// recvState is the receiving half of a session. It follows the sender to the
+// next epoch the first time a packet authenticates under the next key, and
+// keeps the previous key around for packets still in flight.
+type recvState struct {
+	suite  noise.CipherSuite
+	cs     *noise.CipherState
+	prev   *noise.CipherState
+	epoch  uint32
+	replay replayWindow
+}
+
+func newRecvState(suite noise.CipherSuite, cs *noise.CipherState) *recvState {
+	return &recvState{suite: suite, cs: cs}
+}
 
-	return sendCipher, recvCipher, nil
+func (s *sendState) needsRekey() bool {
+	if s.policy.Interval > 0 && time.Since(s.rekeyedAt) >= s.policy.Interval {
+		return true
+	}
+	return s.policy.Bytes > 0 && s.bytes >= s.policy.Bytes
 }
 
-func encryptPacket(cs *noise.CipherState, plaintext []byte) []byte {
-	encryptedPacket, err := cs.Encrypt(nil, nil, plaintext)
+// encryptPacket seals plaintext for the peer, rekeying first if the policy
+// says the current key has been used long enough. It is not safe for
+// concurrent use; callers serialize sends.
+func encryptPacket(s *sendState, plaintext []byte) []byte {
+	if s.needsRekey() {
+		s.cs.Rekey()
+		s.epoch++
+		s.bytes = 0
+		s.rekeyedAt = time.Now()
+		log.Printf("Rekeyed sending key to epoch %d\n", s.epoch)
+	}
+
+	encryptedPacket := make([]byte, packetHeaderLen, packetHeaderLen+len(plaintext)+16)
+	binary.BigEndian.PutUint32(encryptedPacket[0:4], s.epoch)
+	binary.BigEndian.PutUint64(encryptedPacket[4:12], s.cs.Nonce())
+
+	encryptedPacket, err := s.cs.Encrypt(encryptedPacket, encryptedPacket[:packetHeaderLen], plaintext)
 	if err != nil {
 		log.Fatalf("Failed to encrypt packet: %v", err)
 	}
+	s.bytes += uint64(len(plaintext))
 	return encryptedPacket
 }
 
-func decryptPacket(cs *noise.CipherState, ciphertext []byte) ([]byte, error) {
-	decryptedPacket, err := cs.Decrypt(nil, nil, ciphertext)
+func decryptPacket(r *recvState, packet []byte) ([]byte, error) {
+	if len(packet) < packetHeaderLen {
+		return nil, errors.New("packet too short")
+	}
+	header := packet[:packetHeaderLen]
+	epoch := binary.BigEndian.Uint32(header[0:4])
+	counter := binary.BigEndian.Uint64(header[4:12])
+	if counter > noise.MaxNonce || !r.replay.Check(counter) {
+		return nil, errReplayedPacket
+	}
+
+	var cs *noise.CipherState
+	advance := false
+	switch {
+	case epoch == r.epoch:
+		cs = r.cs
+	case epoch == r.epoch-1 && r.prev != nil:
+		cs = r.prev
+	case epoch == r.epoch+1:
+		// Derive the next key on a copy and only commit to it once a
+		// packet authenticates under it
+		cs = noise.UnsafeNewCipherState(r.suite, r.cs.UnsafeKey(), 0)
+		cs.Rekey()
+		advance = true
+	default:
+		return nil, fmt.Errorf("packet from unknown key epoch %d (current %d)", epoch, r.epoch)
+	}
+
+	cs.SetNonce(counter)
+	decryptedPacket, err := cs.Decrypt(nil, header, packet[packetHeaderLen:])
 	if err != nil {
 		return nil, err
 	}
+	r.replay.Accept(counter)
+
+	if advance {
+		r.prev = r.cs
+		r.cs = cs
+		r.epoch = epoch
+		log.Printf("Rekeyed receiving key to epoch %d\n", r.epoch)
+	}
 	return decryptedPacket, nil
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+// Linux/server/cryptography_test.go
+// Packet encryption tests for Linux server build
+// Developer: CyberPanther232
+
+var testSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// newTestStates returns both halves of one direction of a session, keyed
+// alike as they would be after a handshake.
+func newTestStates() (*sendState, *recvState) {
+	var key [32]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	send := newSendState(noise.UnsafeNewCipherState(testSuite, key, 0))
+	recv := newRecvState(testSuite, noise.UnsafeNewCipherState(testSuite, key, 0))
+	return send, recv
+}
+
+// buildPackets encrypts one packet per step: 'p' is a plain packet, 'r' one
+// sent right after a rekey and 'j' one whose counter jumps a whole replay
+// window ahead.
+func buildPackets(t *testing.T, send *sendState, steps string) [][]byte {
+	t.Helper()
+	packets := make([][]byte, len(steps))
+	for i, step := range steps {
+		switch step {
+		case 'p':
+		case 'r':
+			send.policy.Bytes = 1
+			send.bytes = 1
+		case 'j':
+			send.cs.SetNonce(send.cs.Nonce() + replayWindowSize)
+		default:
+			t.Fatalf("unknown step %q", step)
+		}
+		packets[i] = encryptPacket(send, fmt.Appendf(nil, "packet %d", i))
+		send.policy.Bytes = 0
+	}
+	return packets
+}
+
+func TestDecryptPacket(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     string
+		deliver   []int
+		want      []bool
+		wantEpoch uint32
+	}{
+		{"in order", "ppp", []int{0, 1, 2}, []bool{true, true, true}, 0},
+		{"reordered", "ppp", []int{2, 0, 1}, []bool{true, true, true}, 0},
+		{"replayed", "pp", []int{0, 1, 0, 1}, []bool{true, true, false, false}, 0},
+		{"inside window after jump", "pj", []int{0, 1}, []bool{true, true}, 0},
+		{"out of window after jump", "pj", []int{1, 0}, []bool{true, false}, 0},
+		{"epoch rollover", "prp", []int{0, 1, 2}, []bool{true, true, true}, 1},
+		{"previous epoch in flight", "prp", []int{1, 0, 2}, []bool{true, true, true}, 1},
+		{"replay across rollover", "pr", []int{0, 1, 1, 0}, []bool{true, true, false, false}, 1},
+		{"two rollovers", "prr", []int{0, 1, 2}, []bool{true, true, true}, 2},
+		{"two epochs behind", "prr", []int{1, 2, 0}, []bool{true, true, false}, 2},
+		{"skipped epoch", "prr", []int{0, 2, 1}, []bool{true, false, true}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send, recv := newTestStates()
+			packets := buildPackets(t, send, tt.steps)
+			for i, index := range tt.deliver {
+				plaintext, err := decryptPacket(recv, packets[index])
+				if got := err == nil; got != tt.want[i] {
+					t.Fatalf("delivery %d (packet %d): accepted = %v, want %v (err %v)", i, index, got, tt.want[i], err)
+				}
+				if err == nil && !bytes.Equal(plaintext, fmt.Appendf(nil, "packet %d", index)) {
+					t.Fatalf("delivery %d (packet %d): got plaintext %q", i, index, plaintext)
+				}
+			}
+			if recv.epoch != tt.wantEpoch {
+				t.Errorf("receiver ended in epoch %d, want %d", recv.epoch, tt.wantEpoch)
+			}
+		})
+	}
+}
+
+func TestDecryptPacketRejectsMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  string
+		modify func(packet []byte) []byte
+	}{
+		{"too short", "p", func(packet []byte) []byte {
+			return packet[:packetHeaderLen-1]
+		}},
+		{"tampered body", "p", func(packet []byte) []byte {
+			packet[len(packet)-1] ^= 1
+			return packet
+		}},
+		{"tampered counter", "p", func(packet []byte) []byte {
+			packet[11] ^= 1
+			return packet
+		}},
+		{"forged next epoch", "p", func(packet []byte) []byte {
+			binary.BigEndian.PutUint32(packet[0:4], 1)
+			return packet
+		}},
+		{"tampered rekeyed packet", "r", func(packet []byte) []byte {
+			packet[len(packet)-1] ^= 1
+			return packet
+		}},
+		{"counter beyond nonce limit", "p", func(packet []byte) []byte {
+			binary.BigEndian.PutUint64(packet[4:12], noise.MaxNonce+1)
+			return packet
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send, recv := newTestStates()
+			packet := buildPackets(t, send, tt.steps)[0]
+			_, err := decryptPacket(recv, tt.modify(packet))
+			if err == nil {
+				t.Fatal("decryptPacket accepted a malformed packet")
+			}
+			if recv.epoch != 0 || recv.prev != nil {
+				t.Errorf("receiver moved to epoch %d on a packet that did not authenticate", recv.epoch)
+			}
+		})
+	}
+}
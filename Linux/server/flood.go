@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Linux/server/flood.go
+// Handshake flood protection for Linux server build
+// Developer: CyberPanther232
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultHandshakeRate    = 2
+	defaultHandshakeBurst   = 10
+	defaultHandshakeLoad    = 32
+
+	// Cookies are made with a secret that changes this often, and the
+	// previous secret is still accepted
+	cookieSecretLifetime = 2 * time.Minute
+)
+
+// errHandshakeThrottled marks a first message the server dropped instead of
+// processing it. It is not worth a log line per message, which is what a
+// flood would produce.
+var errHandshakeThrottled = errors.New("handshake throttled")
+
+// handshakeGuard decides whether a client's first handshake message is worth
+// the Diffie-Hellman work. While more than load handshakes are in progress a
+// new UDP source must first echo a cookie bound to its address, the way
+// WireGuard does, which spoofed sources cannot. The UDP listener checks it
+// before it keeps anything for the source, so the challenge itself is
+// stateless. Each source IP is then limited to rate handshakes per second,
+// in bursts of up to burst, and may not have more than burst connections
+// waiting for their first message.
+type handshakeGuard struct {
+	rate  float64
+	burst float64
+	load  int64
+
+	// Handshakes past Admit, which is what counts as load
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	buckets   map[netip.Addr]*tokenBucket
+	pending   map[netip.Addr]int
+	lastSweep time.Time
+	secrets   [2][32]byte // current, previous
+	rotated   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newHandshakeGuard creates a guard; a negative rate or load disables the
+// rate limits or the cookie challenge.
+func newHandshakeGuard(rate float64, burst int, load int) *handshakeGuard {
+	g := &handshakeGuard{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		load:    int64(load),
+		buckets: make(map[netip.Addr]*tokenBucket),
+		pending: make(map[netip.Addr]int),
+		rotated: time.Now(),
+	}
+	rand.Read(g.secrets[0][:])
+	rand.Read(g.secrets[1][:])
+	return g
+}
+
+// Enter counts a new connection from addr as waiting for its first message
+// until the returned function is called. It reports false if the source IP
+// already has as many waiting as it may start in a burst, so connections
+// that never send anything cannot pile up.
+func (g *handshakeGuard) Enter(addr net.Addr) (func(), bool) {
+	if g.rate < 0 {
+		return func() {}, true
+	}
+	ip := addrIP(addr)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if float64(g.pending[ip]) >= g.burst {
+		return nil, false
+	}
+	g.pending[ip]++
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.pending[ip]--; g.pending[ip] <= 0 {
+			delete(g.pending, ip)
+		}
+	}, true
+}
+
+// Begin counts an admitted handshake as in progress until the returned
+// function is called.
+func (g *handshakeGuard) Begin() func() {
+	g.inFlight.Add(1)
+	return func() { g.inFlight.Add(-1) }
+}
+
+// Screen checks the first datagram from a new UDP source. While the server
+// is under load it returns the cookie challenge to send back unless the
+// datagram starts with a valid cookie for addr; otherwise it returns the
+// datagram with any cookie removed.
+func (g *handshakeGuard) Screen(addr net.Addr, datagram []byte) ([]byte, []byte) {
+	hasCookie := len(datagram) > 1+cookieLen && datagram[0] == handshakeCookie
+	if g.load >= 0 && g.inFlight.Load() > g.load {
+		if !hasCookie || !g.checkCookie(addr, datagram[1:1+cookieLen]) {
+			return nil, append([]byte{handshakeCookie}, g.cookie(addr, 0)...)
+		}
+	}
+	if hasCookie {
+		datagram = datagram[1+cookieLen:]
+	}
+	return datagram, nil
+}
+
+// Admit reports whether addr may start another handshake, or
+// errHandshakeThrottled if it has used up its rate.
+func (g *handshakeGuard) Admit(addr net.Addr) error {
+	if g.rate >= 0 && !g.allow(addrIP(addr), time.Now()) {
+		return errHandshakeThrottled
+	}
+	return nil
+}
+
+func addrIP(addr net.Addr) netip.Addr {
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// allow takes a token from the bucket of ip, refilled at rate per second.
+// Buckets that have filled up again are forgotten now and then, so the table
+// does not grow with every address ever seen.
+func (g *handshakeGuard) allow(ip netip.Addr, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.lastSweep) > time.Minute {
+		for a, b := range g.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*g.rate >= g.burst {
+				delete(g.buckets, a)
+			}
+		}
+		g.lastSweep = now
+	}
+
+	b, ok := g.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: g.burst, last: now}
+		g.buckets[ip] = b
+	}
+	b.tokens = min(g.burst, b.tokens+now.Sub(b.last).Seconds()*g.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cookie is a MAC of the client's address under the current or previous
+// secret, so checking one needs no per-client state.
+func (g *handshakeGuard) cookie(addr net.Addr, generation int) []byte {
+	g.mu.Lock()
+	if now := time.Now(); now.Sub(g.rotated) > cookieSecretLifetime {
+		g.secrets[1] = g.secrets[0]
+		rand.Read(g.secrets[0][:])
+		g.rotated = now
+	}
+	secret := g.secrets[generation]
+	g.mu.Unlock()
+
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:cookieLen]
+}
+
+func (g *handshakeGuard) checkCookie(addr net.Addr, cookie []byte) bool {
+	return hmac.Equal(cookie, g.cookie(addr, 0)) || hmac.Equal(cookie, g.cookie(addr, 1))
+}
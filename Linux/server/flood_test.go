@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Linux/server/flood_test.go
+// Handshake flood protection tests for Linux server build
+// Developer: CyberPanther232
+
+// loadGuard puts g under load by starting one more handshake than it allows.
+func loadGuard(g *handshakeGuard) func() {
+	var done []func()
+	for range g.load + 1 {
+		done = append(done, g.Begin())
+	}
+	return func() {
+		for _, d := range done {
+			d()
+		}
+	}
+}
+
+func TestHandshakeGuardScreen(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	otherPort := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40001}
+	first := []byte{0x01, 0xaa, 0xbb}
+
+	g := newHandshakeGuard(defaultHandshakeRate, defaultHandshakeBurst, 2)
+	withCookie := func(addr net.Addr) []byte {
+		return append(append([]byte{handshakeCookie}, g.cookie(addr, 0)...), first...)
+	}
+
+	tests := []struct {
+		name          string
+		loaded        bool
+		datagram      []byte
+		wantChallenge bool
+	}{
+		{"idle, no cookie", false, first, false},
+		{"idle, stale cookie is dropped", false, withCookie(otherPort), false},
+		{"loaded, no cookie", true, first, true},
+		{"loaded, valid cookie", true, withCookie(client), false},
+		{"loaded, cookie for another port", true, withCookie(otherPort), true},
+		{"loaded, cookie alone", true, withCookie(client)[:1+cookieLen], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.loaded {
+				defer loadGuard(g)()
+			}
+			datagram, challenge := g.Screen(client, tt.datagram)
+			if tt.wantChallenge {
+				if datagram != nil || len(challenge) != 1+cookieLen || challenge[0] != handshakeCookie {
+					t.Fatalf("got datagram %x and challenge %x, want only a challenge", datagram, challenge)
+				}
+				if !g.checkCookie(client, challenge[1:]) {
+					t.Error("challenge does not carry the cookie for the client's address")
+				}
+				return
+			}
+			if challenge != nil {
+				t.Fatalf("got challenge %x, want none", challenge)
+			}
+			if !bytes.Equal(datagram, first) {
+				t.Errorf("got datagram %x, want %x", datagram, first)
+			}
+		})
+	}
+}
+
+func TestHandshakeGuardCookieRotation(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	g := newHandshakeGuard(defaultHandshakeRate, defaultHandshakeBurst, 0)
+	cookie := g.cookie(client, 0)
+
+	g.rotated = time.Now().Add(-cookieSecretLifetime - time.Second)
+	if !g.checkCookie(client, cookie) {
+		t.Fatal("cookie under the previous secret is refused")
+	}
+	g.rotated = time.Now().Add(-cookieSecretLifetime - time.Second)
+	if g.checkCookie(client, cookie) {
+		t.Fatal("cookie two secrets old is still accepted")
+	}
+}
+
+func TestHandshakeGuardAdmit(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		attempts int
+		wantOK   int
+	}{
+		{"within burst", 2, 5, 5, 5},
+		{"beyond burst", 2, 5, 8, 5},
+		{"disabled", -1, 1, 20, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newHandshakeGuard(tt.rate, tt.burst, -1)
+			client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+			other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}
+			ok := 0
+			for range tt.attempts {
+				err := g.Admit(client)
+				if err == nil {
+					ok++
+				} else if !errors.Is(err, errHandshakeThrottled) {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+			if ok != tt.wantOK {
+				t.Errorf("admitted %d of %d handshakes, want %d", ok, tt.attempts, tt.wantOK)
+			}
+			if err := g.Admit(other); err != nil {
+				t.Errorf("another source IP was throttled: %v", err)
+			}
+		})
+	}
+}
+
+func TestHandshakeGuardEnter(t *testing.T) {
+	g := newHandshakeGuard(defaultHandshakeRate, 3, -1)
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	samePort := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40001}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}
+
+	var leave []func()
+	for i := range 3 {
+		l, ok := g.Enter(client)
+		if !ok {
+			t.Fatalf("connection %d refused within the limit", i+1)
+		}
+		leave = append(leave, l)
+	}
+	if _, ok := g.Enter(samePort); ok {
+		t.Fatal("a fourth waiting connection from the same IP was let in")
+	}
+	if l, ok := g.Enter(other); !ok {
+		t.Fatal("another IP was refused")
+	} else {
+		l()
+	}
+	leave[0]()
+	if _, ok := g.Enter(samePort); !ok {
+		t.Fatal("a connection was refused after another one left")
+	}
+
+	disabled := newHandshakeGuard(-1, 1, -1)
+	for range 5 {
+		if _, ok := disabled.Enter(client); !ok {
+			t.Fatal("Enter limited connections with the limits disabled")
+		}
+	}
+}
+
+// A new UDP source that owes the server a cookie gets its challenge from the
+// listening socket and leaves nothing behind.
+func TestUDPListenerChallengesWithoutState(t *testing.T) {
+	g := newHandshakeGuard(defaultHandshakeRate, defaultHandshakeBurst, 0)
+	defer loadGuard(g)()
+
+	listener, err := listenUDP("127.0.0.1:0", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	l := listener.(*udpListener)
+
+	conn, err := net.Dial("udp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	first := []byte{0x01, 0xaa, 0xbb}
+	_, err = conn.Write(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := make([]byte, maxDatagramSize)
+	n, err := conn.Read(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge = challenge[:n]
+	if n != 1+cookieLen || challenge[0] != handshakeCookie {
+		t.Fatalf("got %x, want a cookie challenge", challenge)
+	}
+	l.mu.Lock()
+	peers := len(l.peers)
+	l.mu.Unlock()
+	if peers != 0 || len(l.accept) != 0 {
+		t.Fatalf("listener kept %d peers and queued %d for a source without a cookie", peers, len(l.accept))
+	}
+
+	_, err = conn.Write(append(challenge, first...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	got, err := peer.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, first) {
+		t.Errorf("first message arrived as %x, want %x without the cookie", got, first)
+	}
+}
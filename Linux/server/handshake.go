@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/flynn/noise"
+)
+
+// Linux/server/handshake.go
+// Handshake pattern selection for Linux server build
+// Developer: CyberPanther232
+
+// handshakePattern is one of the Noise patterns a tunnel can be set up with.
+// Every handshake message on the wire is prefixed with the pattern ID, so a
+// server can tell which pattern a client speaks and refuse it by name instead
+// of failing somewhere inside the Noise state machine.
+type handshakePattern struct {
+	Name         string
+	ID           byte
+	Pattern      noise.HandshakePattern
+	PSKPlacement int // 0 when the pattern carries no pre-shared key
+
+	// Pattern to use instead while the responder's key is still unknown
+	Bootstrap string
+}
+
+var handshakePatterns = map[string]*handshakePattern{
+	"XX":     {Name: "XX", ID: 1, Pattern: noise.HandshakeXX},
+	"IK":     {Name: "IK", ID: 2, Pattern: noise.HandshakeIK, Bootstrap: "XX"},
+	"XXpsk3": {Name: "XXpsk3", ID: 3, Pattern: noise.HandshakeXX, PSKPlacement: 3},
+	"IKpsk2": {Name: "IKpsk2", ID: 4, Pattern: noise.HandshakeIK, PSKPlacement: 2, Bootstrap: "XXpsk3"},
+}
+
+const defaultHandshakePattern = "XX"
+
+// handshakeRefused is the pattern ID of a server's refusal. The rest of the
+// frame lists the patterns and cipher suites the server accepts.
+const handshakeRefused byte = 0
+
+// handshakeCookie is the pattern ID of a cookie challenge from a server under
+// load, which the client answers by sending its first message again with the
+// cookie in front: [handshakeCookie][cookie][first message]. The cookie
+// proves the client can receive at its source address before the server
+// spends any work on the handshake.
+const (
+	handshakeCookie byte = 0x0f
+	cookieLen            = 16
+)
+
+// cookieChallenge is returned by receiveHandshake when the server asks for a
+// cookie instead of answering.
+type cookieChallenge struct {
+	Cookie []byte
+}
+
+func (c *cookieChallenge) Error() string {
+	return "server is under load and sent a cookie challenge"
+}
+
+func lookupHandshakePattern(name string) (*handshakePattern, error) {
+	pattern, ok := handshakePatterns[name]
+	if !ok {
+		names := make([]string, 0, len(handshakePatterns))
+		for n := range handshakePatterns {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown handshake pattern %q (available: %v)", name, names)
+	}
+	return pattern, nil
+}
+
+func handshakePatternByID(id byte) (*handshakePattern, bool) {
+	for _, pattern := range handshakePatterns {
+		if pattern.ID == id {
+			return pattern, true
+		}
+	}
+	return nil, false
+}
+
+func (p *handshakePattern) UsesPSK() bool {
+	return p.PSKPlacement > 0
+}
+
+// KnowsResponder reports whether the initiator must know the responder's
+// static key before the first message, as in IK.
+func (p *handshakePattern) KnowsResponder() bool {
+	return len(p.Pattern.InitiatorPreMessages) == 0 && len(p.Pattern.ResponderPreMessages) > 0
+}
+
+// cipherSuite is one of the Noise cipher suites a tunnel can be encrypted
+// with. The DH function is always Curve25519, which static keys are made for.
+type cipherSuite struct {
+	Name  string
+	ID    byte
+	Suite noise.CipherSuite
+}
+
+var cipherSuites = map[string]*cipherSuite{
+	"AESGCM_SHA256":      {Name: "AESGCM_SHA256", ID: 0, Suite: noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)},
+	"ChaChaPoly_SHA256":  {Name: "ChaChaPoly_SHA256", ID: 1, Suite: noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)},
+	"ChaChaPoly_BLAKE2s": {Name: "ChaChaPoly_BLAKE2s", ID: 2, Suite: noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)},
+	"ChaChaPoly_BLAKE2b": {Name: "ChaChaPoly_BLAKE2b", ID: 3, Suite: noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b)},
+}
+
+const defaultCipherSuite = "AESGCM_SHA256"
+
+func lookupCipherSuite(name string) (*cipherSuite, error) {
+	cs, ok := cipherSuites[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher suite %q (available: %v)", name, cipherSuiteNames())
+	}
+	return cs, nil
+}
+
+func cipherSuiteByID(id byte) (*cipherSuite, bool) {
+	for _, cs := range cipherSuites {
+		if cs.ID == id {
+			return cs, true
+		}
+	}
+	return nil, false
+}
+
+func cipherSuiteNames() []string {
+	names := make([]string, 0, len(cipherSuites))
+	for name := range cipherSuites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handshakeMode is everything the first byte of a handshake message selects.
+// The pattern ID takes the low four bits, the cipher suite ID the next three
+// and hybridFlag the top one. The Noise protocol name covers the pattern and
+// the cipher suite, so a tampered byte makes the handshake fail rather than
+// silently picking something weaker.
+type handshakeMode struct {
+	Pattern *handshakePattern
+	Suite   *cipherSuite
+	Hybrid  bool
+}
+
+const (
+	patternIDMask     byte = 0x0f
+	cipherSuiteIDMask byte = 0x70
+	cipherSuiteShift       = 4
+)
+
+func (m handshakeMode) ID() byte {
+	id := m.Pattern.ID | m.Suite.ID<<cipherSuiteShift
+	if m.Hybrid {
+		id |= hybridFlag
+	}
+	return id
+}
+
+func parseHandshakeMode(id byte) (handshakeMode, bool) {
+	pattern, ok := handshakePatternByID(id & patternIDMask)
+	if !ok {
+		return handshakeMode{}, false
+	}
+	cs, ok := cipherSuiteByID((id & cipherSuiteIDMask) >> cipherSuiteShift)
+	if !ok {
+		return handshakeMode{}, false
+	}
+	return handshakeMode{Pattern: pattern, Suite: cs, Hybrid: id&hybridFlag != 0}, true
+}
+
+// String returns the Noise protocol name, marked if ML-KEM is added.
+func (m handshakeMode) String() string {
+	name := "Noise_" + m.Pattern.Name + "_" + string(m.Suite.Suite.Name())
+	if m.Hybrid {
+		name += hybridSuffix
+	}
+	return name
+}
+
+func handshakeModeName(id byte) string {
+	if mode, ok := parseHandshakeMode(id); ok {
+		return mode.String()
+	}
+	return fmt.Sprintf("#%d", id)
+}
+
+// The prologue is hashed into the handshake by both sides before the first
+// message. It names the protocol, the handshake version, the transport and
+// the mode, so peers that disagree on any of them, because of a downgrade,
+// a relay between transports or another protocol using the same keys, fail
+// the first message that is authenticated instead of agreeing on a session.
+// The protocol version negotiated in the hello needs no place here, as the
+// hello and the reply are authenticated by the handshake already.
+const (
+	prologueProtocol = "Burrow"
+	handshakeVersion = 1
+)
+
+// errPrologueMismatch is reported when a handshake message does not
+// authenticate, which is what a different prologue on the other side leads
+// to.
+var errPrologueMismatch = errors.New("peers disagree on the protocol, handshake version, transport or mode, or the handshake was tampered with")
+
+func handshakePrologue(transport string, mode handshakeMode) []byte {
+	return fmt.Appendf(nil, "%s/%d %s %s", prologueProtocol, handshakeVersion, transport, mode)
+}
+
+func (m handshakeMode) noiseConfig(initiator bool, staticKey noise.DHKey, transport string) noise.Config {
+	return noise.Config{
+		CipherSuite:           m.Suite.Suite,
+		Pattern:               m.Pattern.Pattern,
+		Initiator:             initiator,
+		Prologue:              handshakePrologue(transport, m),
+		StaticKeypair:         staticKey,
+		PresharedKeyPlacement: m.Pattern.PSKPlacement,
+	}
+}
+
+// readHandshakeError explains a handshake message that failed to decrypt.
+// Everything but a truncated message means the message did not authenticate
+// under our handshake hash.
+func readHandshakeError(err error) error {
+	if errors.Is(err, noise.ErrShortMessage) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errPrologueMismatch, err)
+}
+
+// sendHandshake frames a handshake message with its mode ID.
+func sendHandshake(conn Transport, id byte, msg []byte) error {
+	return conn.Send(append([]byte{id}, msg...))
+}
+
+// receiveHandshake reads a handshake message and checks that the peer runs
+// the expected mode.
+func receiveHandshake(conn Transport, id byte) ([]byte, error) {
+	frame, err := conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) == 0 {
+		return nil, errors.New("empty handshake message")
+	}
+	if frame[0] == handshakeRefused {
+		return nil, fmt.Errorf("peer refused %s (accepts %s)", handshakeModeName(id), frame[1:])
+	}
+	if frame[0] == handshakeCookie && len(frame) == 1+cookieLen {
+		return nil, &cookieChallenge{Cookie: frame[1:]}
+	}
+	if frame[0] != id {
+		return nil, fmt.Errorf("peer uses %s, expected %s", handshakeModeName(frame[0]), handshakeModeName(id))
+	}
+	return frame[1:], nil
+}
+
+// refuseHandshake tells the peer which patterns and cipher suites would have
+// been accepted.
+func refuseHandshake(conn Transport, patterns []*handshakePattern, suites []*cipherSuite, hybrid bool) error {
+	patternNames := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		patternNames[i] = pattern.Name
+	}
+	suiteNames := make([]string, len(suites))
+	for i, cs := range suites {
+		suiteNames[i] = cs.Name
+	}
+	accepted := strings.Join(patternNames, ", ") + " with " + strings.Join(suiteNames, ", ")
+	if hybrid {
+		accepted += hybridSuffix
+	}
+	return conn.Send(append([]byte{handshakeRefused}, accepted...))
+}
+
+// keyHintLen is the length of the hint an XX client adds to its first message
+// when it has pinned the server key. A server that holds several keys during
+// a rotation presents the one the hint names.
+const keyHintLen = 8
+
+func keyHint(publicKey []byte) []byte {
+	sum := sha256.Sum256(publicKey)
+	return sum[:keyHintLen]
+}
+
+// handshakeTranscript records our side of a handshake so far. The randomness
+// our ephemeral key is drawn from is fixed up front, which makes the messages
+// we write deterministic, so the state can be rebuilt from scratch with a
+// different pre-shared key.
+type handshakeTranscript struct {
+	config noise.Config
+	seed   []byte
+	steps  []handshakeStep
+}
+
+type handshakeStep struct {
+	write bool
+	data  []byte // the payload we wrote, or the message we read
+}
+
+func newHandshakeTranscript(config noise.Config) (*handshakeTranscript, error) {
+	seed := make([]byte, noise.DH25519.DHLen())
+	_, err := rand.Read(seed)
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeTranscript{config: config, seed: seed}, nil
+}
+
+func (t *handshakeTranscript) start(psk []byte) (*noise.HandshakeState, error) {
+	config := t.config
+	config.PresharedKey = psk
+	config.Random = bytes.NewReader(t.seed)
+	hs, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range t.steps {
+		if step.write {
+			_, _, _, err = hs.WriteMessage(nil, step.data)
+		} else {
+			_, _, _, err = hs.ReadMessage(nil, step.data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hs, nil
+}
+
+func (t *handshakeTranscript) wrote(payload []byte) {
+	t.steps = append(t.steps, handshakeStep{write: true, data: payload})
+}
+
+func (t *handshakeTranscript) read(msg []byte) {
+	t.steps = append(t.steps, handshakeStep{write: false, data: msg})
+}
+
+// defaultPresharedKeyTries bounds how many keys readWithPSK goes through.
+const defaultPresharedKeyTries = 64
+
+// readWithPSK reads a message that mixes in a pre-shared key, trying each
+// candidate key in turn on a fresh copy of the handshake. Every try repeats
+// the handshake so far, Diffie-Hellman operations included, so a message
+// that would need more than limit tries is refused without any; a negative
+// limit allows any number.
+func (t *handshakeTranscript) readWithPSK(msg []byte, keys [][]byte, limit int) (*noise.HandshakeState, []byte, *noise.CipherState, *noise.CipherState, []byte, error) {
+	if len(keys) == 0 {
+		return nil, nil, nil, nil, nil, errors.New("no pre-shared key configured")
+	}
+	if limit >= 0 && len(keys) > limit {
+		return nil, nil, nil, nil, nil, fmt.Errorf("%d pre-shared keys are configured, more than the %d PresharedKeyTries allows", len(keys), limit)
+	}
+	for _, key := range keys {
+		hs, err := t.start(key)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		payload, cs1, cs2, err := hs.ReadMessage(nil, msg)
+		if err == nil {
+			return hs, payload, cs1, cs2, key, nil
+		}
+	}
+	return nil, nil, nil, nil, nil, errors.New("no matching pre-shared key")
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(k, key) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Pre-shared key files hold one key per line, hex or base64, newest first.
+// The first key is used when writing a handshake message and every key is
+// tried when reading one, so a key can be rotated without downtime.
+
+func loadPresharedKeys(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, ok := decodeKey(line)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: pre-shared key must be 32 bytes encoded as hex or base64", path, n+1)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no pre-shared key found", path)
+	}
+	return keys, nil
+}
+
+func generatePresharedKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// rotatePresharedKey adds a key to a key file, keeping the keys already
+// there, and generates it unless one is given. A key put first is written
+// from the next handshake on; a key added last is only accepted while the
+// keys above it remain, which lets one side learn a key before the other
+// starts to use it.
+func rotatePresharedKey(path, key string, first bool) (string, error) {
+	if key == "" {
+		var err error
+		key, err = generatePresharedKey()
+		if err != nil {
+			return "", err
+		}
+	} else if _, ok := decodeKey(key); !ok {
+		return "", errors.New("pre-shared key must be 32 bytes encoded as hex or base64")
+	}
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var data []byte
+	if first {
+		data = append([]byte(key+"\n"), old...)
+	} else {
+		data = old
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		data = append(data, key+"\n"...)
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return "", err
+	}
+	return key, os.Rename(tmp, path)
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// Linux/server/handshake_test.go
+// Handshake round trip tests for Linux server build
+// Developer: CyberPanther232
+
+// pipeTransport is one end of an in-memory Transport pair. Closing one end
+// ends the other's Receive, so a side that gives up does not leave the other
+// waiting.
+type pipeTransport struct {
+	in, out chan []byte
+	once    sync.Once
+}
+
+func newPipe() (*pipeTransport, *pipeTransport) {
+	a, b := make(chan []byte, 8), make(chan []byte, 8)
+	return &pipeTransport{in: a, out: b}, &pipeTransport{in: b, out: a}
+}
+
+func (p *pipeTransport) Send(message []byte) error {
+	p.out <- bytes.Clone(message)
+	return nil
+}
+
+func (p *pipeTransport) Receive() ([]byte, error) {
+	select {
+	case msg, ok := <-p.in:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("timed out waiting for a message")
+	}
+}
+
+func (p *pipeTransport) Close() error {
+	p.once.Do(func() { close(p.out) })
+	return nil
+}
+
+func (p *pipeTransport) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+}
+
+func (p *pipeTransport) SetDeadline(time.Time) error {
+	return nil
+}
+
+func generateTestKey(t *testing.T) noise.DHKey {
+	t.Helper()
+	key, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testPresharedKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// testClient runs the initiator side of the handshake the way the client
+// program does, without the logging and the cookie exchange.
+type testClient struct {
+	Mode          handshakeMode
+	Key           noise.DHKey
+	ServerKey     []byte // pinned server key, if any
+	PresharedKeys [][]byte
+	Transport     string
+}
+
+// testSession is what the client is left with after a handshake.
+type testSession struct {
+	send           *sendState
+	recv           *recvState
+	serverKey      []byte
+	channelBinding []byte
+	reply          []byte
+}
+
+func (c testClient) handshake(conn Transport, hello []byte) (*testSession, error) {
+	mode, pattern := c.Mode, c.Mode.Pattern
+	config := mode.noiseConfig(true, c.Key, c.Transport)
+	if pattern.KnowsResponder() {
+		config.PeerStatic = c.ServerKey
+	}
+	transcript, err := newHandshakeTranscript(config)
+	if err != nil {
+		return nil, err
+	}
+	hs, err := transcript.start(nil)
+	if err != nil {
+		return nil, err
+	}
+	var decapsulationKey *mlkem.DecapsulationKey768
+	var kemSecret []byte
+	if mode.Hybrid {
+		decapsulationKey, err = mlkem.GenerateKey768()
+		if err != nil {
+			return nil, err
+		}
+	}
+	id := mode.ID()
+
+	messages := len(pattern.Pattern.Messages)
+	lastFromClient := (messages - 1) &^ 1
+	pskMessage := pattern.PSKPlacement - 1
+	replyInHandshake := lastFromClient != messages-1 && !mode.Hybrid
+	var reply []byte
+	var sendCipher, recvCipher *noise.CipherState
+	for i := 0; i < messages; i++ {
+		if i%2 == 0 {
+			var payload []byte
+			if i == 0 && mode.Hybrid {
+				payload = append(payload, decapsulationKey.EncapsulationKey().Bytes()...)
+			}
+			if i == 0 && !pattern.KnowsResponder() && c.ServerKey != nil {
+				payload = append(payload, keyHint(c.ServerKey)...)
+			}
+			if i == lastFromClient {
+				payload = append(payload, hello...)
+			}
+			if i == pskMessage {
+				hs.SetPresharedKey(c.PresharedKeys[0])
+			}
+			msg, cs1, cs2, err := hs.WriteMessage(nil, payload)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i+1, err)
+			}
+			transcript.wrote(payload)
+			recvCipher, sendCipher = cs1, cs2
+			err = sendHandshake(conn, id, msg)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			msg, err := receiveHandshake(conn, id)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i+1, err)
+			}
+			var payload []byte
+			var cs1, cs2 *noise.CipherState
+			if i == pskMessage {
+				hs, payload, cs1, cs2, _, err = transcript.readWithPSK(msg, c.PresharedKeys, -1)
+			} else {
+				payload, cs1, cs2, err = hs.ReadMessage(nil, msg)
+				if err != nil {
+					err = readHandshakeError(err)
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i+1, err)
+			}
+			transcript.read(msg)
+			recvCipher, sendCipher = cs1, cs2
+			if i == 1 && mode.Hybrid {
+				var ciphertext []byte
+				ciphertext, payload, err = splitKEM(payload, mlkem.CiphertextSize768)
+				if err == nil {
+					kemSecret, err = decapsulationKey.Decapsulate(ciphertext)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("message %d: %w", i+1, err)
+				}
+			}
+			if i == messages-1 && replyInHandshake {
+				reply = payload
+			}
+		}
+	}
+	if mode.Hybrid {
+		sendCipher, err = mixKEMSecret(mode.Suite.Suite, sendCipher, kemSecret, hs.ChannelBinding())
+		if err == nil {
+			recvCipher, err = mixKEMSecret(mode.Suite.Suite, recvCipher, kemSecret, hs.ChannelBinding())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	session := &testSession{
+		send:           newSendState(sendCipher),
+		recv:           newRecvState(mode.Suite.Suite, recvCipher),
+		serverKey:      hs.PeerStatic(),
+		channelBinding: hs.ChannelBinding(),
+		reply:          reply,
+	}
+	if !replyInHandshake {
+		msg, err := conn.Receive()
+		if err != nil {
+			return nil, fmt.Errorf("reply: %w", err)
+		}
+		session.reply, err = decryptPacket(session.recv, msg)
+		if err != nil {
+			return nil, fmt.Errorf("reply: %w", err)
+		}
+	}
+	return session, nil
+}
+
+// testServerOptions accepts every pattern and cipher suite without a hybrid
+// handshake, with keys as the pre-shared keys of every client.
+func testServerOptions(keys ...[]byte) handshakeOptions {
+	opts := handshakeOptions{
+		PresharedKeys:     func([]byte) [][]byte { return keys },
+		PresharedKeyTries: defaultPresharedKeyTries,
+		Timeout:           5 * time.Second,
+		Transport:         "tcp",
+	}
+	for _, name := range []string{"XX", "IK", "XXpsk3", "IKpsk2"} {
+		opts.Patterns = append(opts.Patterns, handshakePatterns[name])
+	}
+	for _, name := range cipherSuiteNames() {
+		opts.CipherSuites = append(opts.CipherSuites, cipherSuites[name])
+	}
+	return opts
+}
+
+func testMode(pattern string) handshakeMode {
+	return handshakeMode{Pattern: handshakePatterns[pattern], Suite: cipherSuites[defaultCipherSuite]}
+}
+
+// handshakeResult is how a round trip went on both sides.
+type handshakeResult struct {
+	client     *testSession
+	clientErr  error
+	serverErr  error
+	serverMode handshakeMode
+	serverPeer []byte
+	send       *sendState
+	recv       *recvState
+	binding    []byte
+}
+
+// runHandshake runs client against runServerHandshake over a pipe. The
+// server answers the hello "hello" with "welcome".
+func runHandshake(client testClient, serverKeys []noise.DHKey, opts handshakeOptions) handshakeResult {
+	clientConn, serverConn := newPipe()
+	var result handshakeResult
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer serverConn.Close()
+		result.send, result.recv, result.binding, result.serverErr = runServerHandshake(serverConn, serverKeys, opts, func(mode handshakeMode, peerStatic, hello []byte) ([]byte, error) {
+			result.serverMode, result.serverPeer = mode, peerStatic
+			if string(hello) != "hello" {
+				return nil, fmt.Errorf("unexpected hello %q", hello)
+			}
+			return []byte("welcome"), nil
+		})
+	}()
+	result.client, result.clientErr = client.handshake(clientConn, []byte("hello"))
+	clientConn.Close()
+	<-done
+	return result
+}
+
+// checkRoundTrip fails unless both sides agree on the session: the reply
+// arrived, the keys match in both directions and each side knows the other.
+func checkRoundTrip(t *testing.T, client testClient, serverKey noise.DHKey, result handshakeResult) {
+	t.Helper()
+	if result.serverErr != nil || result.clientErr != nil {
+		t.Fatalf("handshake failed: server: %v, client: %v", result.serverErr, result.clientErr)
+	}
+	if string(result.client.reply) != "welcome" {
+		t.Errorf("client got reply %q, want %q", result.client.reply, "welcome")
+	}
+	if result.serverMode != client.Mode {
+		t.Errorf("server saw mode %s, want %s", result.serverMode, client.Mode)
+	}
+	if !bytes.Equal(result.serverPeer, client.Key.Public) {
+		t.Error("server saw another client key")
+	}
+	if !bytes.Equal(result.client.serverKey, serverKey.Public) {
+		t.Error("client saw another server key")
+	}
+	if !bytes.Equal(result.client.channelBinding, result.binding) {
+		t.Error("client and server ended with different handshake hashes")
+	}
+	got, err := decryptPacket(result.recv, encryptPacket(result.client.send, []byte("ping")))
+	if err != nil || string(got) != "ping" {
+		t.Errorf("client to server: got %q, %v", got, err)
+	}
+	got, err = decryptPacket(result.client.recv, encryptPacket(result.send, []byte("pong")))
+	if err != nil || string(got) != "pong" {
+		t.Errorf("server to client: got %q, %v", got, err)
+	}
+}
+
+func TestHandshakePresharedKeys(t *testing.T) {
+	current, old, other := testPresharedKey(1), testPresharedKey(2), testPresharedKey(3)
+	tests := []struct {
+		name       string
+		pattern    string
+		clientKeys [][]byte
+		serverKeys [][]byte
+		tries      int
+		ok         bool
+		serverErr  string
+	}{
+		{"XXpsk3", "XXpsk3", [][]byte{current}, [][]byte{current}, defaultPresharedKeyTries, true, ""},
+		{"XXpsk3 with the old key", "XXpsk3", [][]byte{old}, [][]byte{current, old}, defaultPresharedKeyTries, true, ""},
+		{"XXpsk3 with a wrong key", "XXpsk3", [][]byte{other}, [][]byte{current, old}, defaultPresharedKeyTries, false, "no matching pre-shared key"},
+		{"XXpsk3 within the tries", "XXpsk3", [][]byte{old}, [][]byte{current, old}, 2, true, ""},
+		{"XXpsk3 beyond the tries", "XXpsk3", [][]byte{current}, [][]byte{current, old}, 1, false, "PresharedKeyTries"},
+		{"XXpsk3 without a limit", "XXpsk3", [][]byte{old}, [][]byte{current, old}, -1, true, ""},
+		{"IKpsk2", "IKpsk2", [][]byte{current}, [][]byte{current, old}, defaultPresharedKeyTries, true, ""},
+		{"IKpsk2 with the old key", "IKpsk2", [][]byte{current, old}, [][]byte{old}, defaultPresharedKeyTries, true, ""},
+		{"IKpsk2 with a wrong key", "IKpsk2", [][]byte{other}, [][]byte{current}, defaultPresharedKeyTries, false, ""},
+	}
+	serverKey := generateTestKey(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := testClient{Mode: testMode(tt.pattern), Key: generateTestKey(t), ServerKey: serverKey.Public, PresharedKeys: tt.clientKeys, Transport: "tcp"}
+			opts := testServerOptions(tt.serverKeys...)
+			opts.PresharedKeyTries = tt.tries
+			result := runHandshake(client, []noise.DHKey{serverKey}, opts)
+			if tt.ok {
+				checkRoundTrip(t, client, serverKey, result)
+				return
+			}
+			if result.clientErr == nil {
+				t.Fatal("client finished a handshake that should have failed")
+			}
+			if tt.serverErr != "" && (result.serverErr == nil || !strings.Contains(result.serverErr.Error(), tt.serverErr)) {
+				t.Errorf("server error %v, want one mentioning %q", result.serverErr, tt.serverErr)
+			}
+		})
+	}
+}
+
+// An XXpsk3 client only names itself in the message that carries the key, so
+// the server tries every configured key and then checks the one that worked
+// belongs to the client.
+func TestHandshakePresharedKeyOfAnotherPeer(t *testing.T) {
+	serverKey, clientKey := generateTestKey(t), generateTestKey(t)
+	own, others := testPresharedKey(1), testPresharedKey(2)
+	opts := testServerOptions()
+	opts.PresharedKeys = func(peerStatic []byte) [][]byte {
+		if bytes.Equal(peerStatic, clientKey.Public) {
+			return [][]byte{own}
+		}
+		return [][]byte{own, others}
+	}
+
+	client := testClient{Mode: testMode("XXpsk3"), Key: clientKey, PresharedKeys: [][]byte{own}, Transport: "tcp"}
+	checkRoundTrip(t, client, serverKey, runHandshake(client, []noise.DHKey{serverKey}, opts))
+
+	client.PresharedKeys = [][]byte{others}
+	result := runHandshake(client, []noise.DHKey{serverKey}, opts)
+	if result.serverErr == nil || !strings.Contains(result.serverErr.Error(), "not configured for this client") {
+		t.Errorf("server error %v, want the key refused for this client", result.serverErr)
+	}
+}
+
+func TestAuthorizePeerRequiresPresharedKey(t *testing.T) {
+	withPSK, withoutPSK := generateTestKey(t), generateTestKey(t)
+	srv := &Server{peers: &AuthorizedPeers{peers: map[string]*AuthorizedPeer{
+		hex.EncodeToString(withPSK.Public):    {Name: "with-psk", PresharedKeyFile: "psk.txt"},
+		hex.EncodeToString(withoutPSK.Public): {Name: "without-psk"},
+	}}}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		pattern string
+		ok      bool
+	}{
+		{"own key with XXpsk3", withPSK.Public, "XXpsk3", true},
+		{"own key with IKpsk2", withPSK.Public, "IKpsk2", true},
+		{"own key with XX", withPSK.Public, "XX", false},
+		{"own key with IK", withPSK.Public, "IK", false},
+		{"no own key with XX", withoutPSK.Public, "XX", true},
+		{"no own key with XXpsk3", withoutPSK.Public, "XXpsk3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := srv.authorizePeer(tt.key, &ClientHello{}, testMode(tt.pattern), remote)
+			if (err == nil) != tt.ok {
+				t.Errorf("authorizePeer = %v, want accepted = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHandshakePatterns(t *testing.T) {
+	serverKey := generateTestKey(t)
+	tests := []struct {
+		name      string
+		pattern   string
+		pinned    []byte
+		accepted  []string
+		ok        bool
+		serverErr string
+	}{
+		{"XX", "XX", nil, nil, true, ""},
+		{"XX with a pinned key", "XX", serverKey.Public, nil, true, ""},
+		{"IK", "IK", serverKey.Public, nil, true, ""},
+		{"IK to the wrong key", "IK", generateTestKey(t).Public, nil, false, "not meant for any server key"},
+		{"IK where only XX is accepted", "IK", serverKey.Public, []string{"XX"}, false, "not accepted"},
+		{"XX where only psk patterns are accepted", "XX", nil, []string{"XXpsk3", "IKpsk2"}, false, "not accepted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := testClient{Mode: testMode(tt.pattern), Key: generateTestKey(t), ServerKey: tt.pinned, Transport: "tcp"}
+			opts := testServerOptions()
+			if tt.accepted != nil {
+				opts.Patterns = nil
+				for _, name := range tt.accepted {
+					opts.Patterns = append(opts.Patterns, handshakePatterns[name])
+				}
+			}
+			result := runHandshake(client, []noise.DHKey{serverKey}, opts)
+			if tt.ok {
+				checkRoundTrip(t, client, serverKey, result)
+				return
+			}
+			if result.clientErr == nil {
+				t.Fatal("client finished a handshake that should have failed")
+			}
+			if result.serverErr == nil || !strings.Contains(result.serverErr.Error(), tt.serverErr) {
+				t.Errorf("server error %v, want one mentioning %q", result.serverErr, tt.serverErr)
+			}
+		})
+	}
+}
+
+// A refused client learns from the refusal which patterns the server takes.
+func TestHandshakeRefusalNamesAcceptedPatterns(t *testing.T) {
+	opts := testServerOptions()
+	opts.Patterns = []*handshakePattern{handshakePatterns["XX"]}
+	client := testClient{Mode: testMode("XXpsk3"), Key: generateTestKey(t), PresharedKeys: [][]byte{testPresharedKey(1)}, Transport: "tcp"}
+	result := runHandshake(client, []noise.DHKey{generateTestKey(t)}, opts)
+	if result.clientErr == nil || !strings.Contains(result.clientErr.Error(), "refused") || !strings.Contains(result.clientErr.Error(), "accepts XX with") {
+		t.Errorf("client error %v, want a refusal naming XX", result.clientErr)
+	}
+}
+
+func TestHandshakeHybrid(t *testing.T) {
+	serverKey := generateTestKey(t)
+	psk := testPresharedKey(1)
+	tests := []struct {
+		name         string
+		pattern      string
+		clientHybrid bool
+		serverHybrid bool
+		ok           bool
+	}{
+		{"XX", "XX", true, true, true},
+		{"IK", "IK", true, true, true},
+		{"XXpsk3", "XXpsk3", true, true, true},
+		{"IKpsk2", "IKpsk2", true, true, true},
+		{"client without ML-KEM", "XX", false, true, false},
+		{"server without ML-KEM", "IK", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := testMode(tt.pattern)
+			mode.Hybrid = tt.clientHybrid
+			client := testClient{Mode: mode, Key: generateTestKey(t), ServerKey: serverKey.Public, PresharedKeys: [][]byte{psk}, Transport: "tcp"}
+			opts := testServerOptions(psk)
+			opts.Hybrid = tt.serverHybrid
+			result := runHandshake(client, []noise.DHKey{serverKey}, opts)
+			if tt.ok {
+				checkRoundTrip(t, client, serverKey, result)
+				return
+			}
+			if result.clientErr == nil || result.serverErr == nil || !strings.Contains(result.serverErr.Error(), "not accepted") {
+				t.Errorf("server: %v, client: %v, want the mode refused", result.serverErr, result.clientErr)
+			}
+		})
+	}
+}
+
+// The hybrid keys depend on the ML-KEM secret, so a session whose X25519
+// keys were recovered is still not readable without it.
+func TestMixKEMSecret(t *testing.T) {
+	suite := cipherSuites[defaultCipherSuite].Suite
+	noiseKey := noise.UnsafeNewCipherState(suite, [32]byte{1}, 0)
+	binding := []byte("handshake hash")
+	mix := func(secret byte) *noise.CipherState {
+		cs, err := mixKEMSecret(suite, noiseKey, bytes.Repeat([]byte{secret}, 32), binding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+
+	sealed, err := mix(1).Encrypt(nil, nil, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := noise.UnsafeNewCipherState(suite, [32]byte{1}, 0).Decrypt(nil, nil, sealed); err == nil {
+		t.Error("the Noise key alone opened a hybrid message")
+	}
+	if _, err := mix(2).Decrypt(nil, nil, sealed); err == nil {
+		t.Error("another ML-KEM secret opened a hybrid message")
+	}
+	if got, err := mix(1).Decrypt(nil, nil, sealed); err != nil || string(got) != "ping" {
+		t.Errorf("the same secret got %q, %v", got, err)
+	}
+}
+
+func TestHandshakeCipherSuites(t *testing.T) {
+	serverKey := generateTestKey(t)
+	for _, name := range cipherSuiteNames() {
+		for _, pattern := range []string{"XX", "IK"} {
+			t.Run(name+" "+pattern, func(t *testing.T) {
+				mode := testMode(pattern)
+				mode.Suite = cipherSuites[name]
+				client := testClient{Mode: mode, Key: generateTestKey(t), ServerKey: serverKey.Public, Transport: "tcp"}
+				checkRoundTrip(t, client, serverKey, runHandshake(client, []noise.DHKey{serverKey}, testServerOptions()))
+			})
+		}
+	}
+
+	t.Run("suite not accepted", func(t *testing.T) {
+		mode := testMode("XX")
+		mode.Suite = cipherSuites["ChaChaPoly_BLAKE2b"]
+		client := testClient{Mode: mode, Key: generateTestKey(t), Transport: "tcp"}
+		opts := testServerOptions()
+		opts.CipherSuites = []*cipherSuite{cipherSuites["AESGCM_SHA256"], cipherSuites["ChaChaPoly_BLAKE2s"]}
+		result := runHandshake(client, []noise.DHKey{serverKey}, opts)
+		if result.clientErr == nil || !strings.Contains(result.clientErr.Error(), "accepts XX, IK, XXpsk3, IKpsk2 with AESGCM_SHA256, ChaChaPoly_BLAKE2s") {
+			t.Errorf("client error %v, want a refusal naming the accepted suites", result.clientErr)
+		}
+	})
+}
+
+func TestHandshakeModeID(t *testing.T) {
+	seen := make(map[byte]string)
+	for _, pattern := range handshakePatterns {
+		for _, suite := range cipherSuites {
+			for _, hybrid := range []bool{false, true} {
+				mode := handshakeMode{Pattern: pattern, Suite: suite, Hybrid: hybrid}
+				id := mode.ID()
+				if id == handshakeRefused || id == handshakeCookie {
+					t.Errorf("%s has the reserved ID %#x", mode, id)
+				}
+				if other, ok := seen[id]; ok {
+					t.Errorf("%s and %s share the ID %#x", mode, other, id)
+				}
+				seen[id] = mode.String()
+				parsed, ok := parseHandshakeMode(id)
+				if !ok || parsed != mode {
+					t.Errorf("ID %#x of %s parses as %v, %v", id, mode, parsed, ok)
+				}
+			}
+		}
+	}
+	if _, ok := parseHandshakeMode(0x71); ok {
+		t.Error("an unknown cipher suite ID parsed")
+	}
+}
+
+// Peers that disagree on anything in the prologue fail at the first message
+// that is authenticated, with an error saying so.
+func TestHandshakePrologueMismatch(t *testing.T) {
+	serverKey := generateTestKey(t)
+	for _, pattern := range []string{"XX", "IK"} {
+		t.Run(pattern, func(t *testing.T) {
+			client := testClient{Mode: testMode(pattern), Key: generateTestKey(t), ServerKey: serverKey.Public, Transport: "udp"}
+			result := runHandshake(client, []noise.DHKey{serverKey}, testServerOptions())
+			if !errors.Is(result.clientErr, errPrologueMismatch) && !errors.Is(result.serverErr, errPrologueMismatch) {
+				t.Errorf("server: %v, client: %v, want %v", result.serverErr, result.clientErr, errPrologueMismatch)
+			}
+		})
+	}
+}
+
+func TestHandshakePrologue(t *testing.T) {
+	base := handshakePrologue("tcp", testMode("XX"))
+	if string(base) != "Burrow/1 tcp Noise_XX_25519_AESGCM_SHA256" {
+		t.Errorf("prologue %q", base)
+	}
+	hybrid := testMode("XX")
+	hybrid.Hybrid = true
+	suite := testMode("XX")
+	suite.Suite = cipherSuites["ChaChaPoly_BLAKE2s"]
+	for name, prologue := range map[string][]byte{
+		"transport": handshakePrologue("udp", testMode("XX")),
+		"pattern":   handshakePrologue("tcp", testMode("IK")),
+		"suite":     handshakePrologue("tcp", suite),
+		"hybrid":    handshakePrologue("tcp", hybrid),
+	} {
+		if bytes.Equal(prologue, base) {
+			t.Errorf("the prologue does not change with the %s", name)
+		}
+	}
+}
+
+// During a rotation the server holds several keys. IK clients encrypt to the
+// one they know, XX clients name theirs in a hint, and everyone else is
+// answered with the current key.
+func TestHandshakeServerKeySelection(t *testing.T) {
+	current, next, previous := generateTestKey(t), generateTestKey(t), generateTestKey(t)
+	unknown := generateTestKey(t)
+	serverKeys := []noise.DHKey{current, next, previous}
+	tests := []struct {
+		name    string
+		pattern string
+		hybrid  bool
+		pinned  []byte
+		want    *noise.DHKey
+	}{
+		{"XX without a pin", "XX", false, nil, &current},
+		{"XX pinned to the current key", "XX", false, current.Public, &current},
+		{"XX pinned to the next key", "XX", false, next.Public, &next},
+		{"XX pinned to the previous key", "XX", false, previous.Public, &previous},
+		{"XX pinned to an unknown key", "XX", false, unknown.Public, &current},
+		{"hybrid XX pinned to the next key", "XX", true, next.Public, &next},
+		{"IK to the current key", "IK", false, current.Public, &current},
+		{"IK to the next key", "IK", false, next.Public, &next},
+		{"IK to the previous key", "IK", false, previous.Public, &previous},
+		{"hybrid IK to the previous key", "IK", true, previous.Public, &previous},
+		{"IK to an unknown key", "IK", false, unknown.Public, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := testMode(tt.pattern)
+			mode.Hybrid = tt.hybrid
+			client := testClient{Mode: mode, Key: generateTestKey(t), ServerKey: tt.pinned, Transport: "tcp"}
+			opts := testServerOptions()
+			opts.Hybrid = tt.hybrid
+			result := runHandshake(client, serverKeys, opts)
+			if tt.want == nil {
+				if result.serverErr == nil || result.clientErr == nil {
+					t.Errorf("server: %v, client: %v, want the handshake to fail", result.serverErr, result.clientErr)
+				}
+				return
+			}
+			checkRoundTrip(t, client, *tt.want, result)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// Linux/server/icmp_test.go
+// ICMP destination unreachable tests for Linux server build
+// Developer: CyberPanther232
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		initial uint32
+		want    uint16
+	}{
+		{"empty", nil, 0, 0xffff},
+		{"RFC 1071 example", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0, 0x220d},
+		{"IPv4 header", []byte{
+			0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11,
+			0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+		}, 0, 0xb861},
+		{"odd length pads with zero", []byte{0x01}, 0, 0xfeff},
+		{"initial sum folds its carry", nil, 0x1ffff, 0xfffe},
+		{"initial sum is added", []byte{0x00, 0x01}, 0x0001, 0xfffd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checksum(tt.data, tt.initial); got != tt.want {
+				t.Errorf("checksum = %#04x, want %#04x", got, tt.want)
+			}
+		})
+	}
+}
+
+func testIPv4Packet(src, dst string, proto byte, payload []byte) []byte {
+	packet := make([]byte, ipv4HeaderLen+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = proto
+	s := netip.MustParseAddr(src).As4()
+	d := netip.MustParseAddr(dst).As4()
+	copy(packet[12:16], s[:])
+	copy(packet[16:20], d[:])
+	copy(packet[ipv4HeaderLen:], payload)
+	return packet
+}
+
+func testIPv6Packet(src, dst string, next byte, payload []byte) []byte {
+	packet := make([]byte, ipv6HeaderLen+len(payload))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(payload)))
+	packet[6] = next
+	packet[7] = 64
+	s := netip.MustParseAddr(src).As16()
+	d := netip.MustParseAddr(dst).As16()
+	copy(packet[8:24], s[:])
+	copy(packet[24:40], d[:])
+	copy(packet[ipv6HeaderLen:], payload)
+	return packet
+}
+
+func TestBuildUnreachable(t *testing.T) {
+	const protoUDP = 17
+	udp := make([]byte, 16)
+	fragment := testIPv4Packet("10.8.0.2", "10.9.0.1", protoUDP, udp)
+	binary.BigEndian.PutUint16(fragment[6:8], 185)
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		gateway string
+		want    bool
+	}{
+		{"IPv4 UDP", testIPv4Packet("10.8.0.2", "10.9.0.1", protoUDP, udp), "10.8.0.1", true},
+		{"IPv4 echo request", testIPv4Packet("10.8.0.2", "10.9.0.1", protoICMPv4, []byte{8, 0, 0, 0, 0, 1, 0, 1}), "10.8.0.1", true},
+		{"IPv4 ICMP error", testIPv4Packet("10.8.0.2", "10.9.0.1", protoICMPv4, []byte{3, 1, 0, 0, 0, 0, 0, 0}), "10.8.0.1", false},
+		{"IPv4 multicast", testIPv4Packet("10.8.0.2", "224.0.0.251", protoUDP, udp), "10.8.0.1", false},
+		{"IPv4 broadcast", testIPv4Packet("10.8.0.2", "255.255.255.255", protoUDP, udp), "10.8.0.1", false},
+		{"IPv4 later fragment", fragment, "10.8.0.1", false},
+		{"IPv4 without an IPv4 gateway", testIPv4Packet("10.8.0.2", "10.9.0.1", protoUDP, udp), "fd00::1", false},
+		{"IPv6 UDP", testIPv6Packet("fd00::2", "fd01::1", protoUDP, udp), "fd00::1", true},
+		{"IPv6 echo request", testIPv6Packet("fd00::2", "fd01::1", protoICMPv6, []byte{128, 0, 0, 0, 0, 1, 0, 1}), "fd00::1", true},
+		{"IPv6 ICMP error", testIPv6Packet("fd00::2", "fd01::1", protoICMPv6, []byte{1, 0, 0, 0, 0, 0, 0, 0}), "fd00::1", false},
+		{"IPv6 multicast", testIPv6Packet("fd00::2", "ff02::fb", protoUDP, udp), "fd00::1", false},
+		{"IPv6 unspecified source", testIPv6Packet("::", "fd01::1", protoUDP, udp), "fd00::1", false},
+		{"IPv6 without an IPv6 gateway", testIPv6Packet("fd00::2", "fd01::1", protoUDP, udp), "10.8.0.1", false},
+		{"truncated", []byte{0x45, 0x00}, "10.8.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, ok := buildUnreachable(tt.packet, netip.MustParseAddr(tt.gateway))
+			if ok != tt.want {
+				t.Fatalf("buildUnreachable returned %v, want %v", ok, tt.want)
+			}
+			if !ok {
+				return
+			}
+
+			// A correct checksum makes the sum over the covered bytes,
+			// checksum included, come out as zero
+			src, _ := packetSource(tt.packet)
+			if dst, _ := packetDestination(reply); dst != src {
+				t.Errorf("reply goes to %s, want the sender %s", dst, src)
+			}
+			switch ipVersion(reply) {
+			case 4:
+				if got := checksum(reply[:ipv4HeaderLen], 0); got != 0 {
+					t.Errorf("IPv4 header checksum does not verify (%#04x)", got)
+				}
+				if got := checksum(reply[ipv4HeaderLen:], 0); got != 0 {
+					t.Errorf("ICMP checksum does not verify (%#04x)", got)
+				}
+			case 6:
+				icmp := reply[ipv6HeaderLen:]
+				pseudo := sumWords(reply[8:40], uint32(len(icmp))+protoICMPv6)
+				if got := checksum(icmp, pseudo); got != 0 {
+					t.Errorf("ICMPv6 checksum does not verify (%#04x)", got)
+				}
+			default:
+				t.Fatalf("reply is not an IP packet")
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Linux/server/ipam.go
+// Address pool and lease management for Linux server build
+// Developer: CyberPanther232
+
+// Lease binds a client static key to an address from the pool. Leases are
+// sticky: a returning client gets the same address until its lease expires.
+type Lease struct {
+	ClientKey string    `yaml:"ClientKey"`
+	Address   string    `yaml:"Address"`
+	Expires   time.Time `yaml:"Expires"`
+}
+
+type AddressPool struct {
+	mu       sync.Mutex
+	prefix   netip.Prefix
+	gateway  netip.Addr
+	duration time.Duration
+	path     string
+
+	leases   map[string]*Lease // keyed by hex client key
+	active   map[string]int    // live sessions per client key
+	reserved []netip.Prefix    // routed to peers by their AllowedAddresses
+}
+
+func newAddressPool(prefix netip.Prefix, gateway netip.Addr, duration time.Duration, path string) (*AddressPool, error) {
+	prefix = prefix.Masked()
+	if !prefix.Contains(gateway) {
+		return nil, fmt.Errorf("server address %s is outside the address pool %s", gateway, prefix)
+	}
+
+	pool := &AddressPool{
+		prefix:   prefix,
+		gateway:  gateway,
+		duration: duration,
+		path:     path,
+		leases:   make(map[string]*Lease),
+		active:   make(map[string]int),
+	}
+
+	err := pool.load()
+	if err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func (p *AddressPool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+func (p *AddressPool) Gateway() netip.Addr {
+	return p.gateway
+}
+
+// Reserve keeps the addresses within prefixes out of the pool, as they are
+// routed to peers by their AllowedAddresses and a lease on one of them would
+// take its traffic. Leases already on them are given up.
+func (p *AddressPool) Reserve(prefixes []netip.Prefix) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, prefix := range prefixes {
+		if prefix.Overlaps(p.prefix) {
+			p.reserved = append(p.reserved, prefix)
+		}
+	}
+}
+
+// Acquire returns the address leased to clientKey, allocating a new one if
+// the client has no lease or its lease has expired and been reassigned.
+func (p *AddressPool) Acquire(clientKey []byte) (netip.Addr, error) {
+	key := hex.EncodeToString(clientKey)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	lease, ok := p.leases[key]
+	if ok {
+		if _, valid := p.leaseAddr(lease); !valid {
+			delete(p.leases, key)
+			ok = false
+		}
+	}
+	if !ok {
+		addr, err := p.nextFree(now)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		lease = &Lease{ClientKey: key, Address: addr.String()}
+		p.leases[key] = lease
+	}
+	lease.Expires = now.Add(p.duration)
+
+	// Only a lease handed out is counted, or a failed save would leave a
+	// reference nobody releases
+	err := p.save()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	p.active[key]++
+	return netip.ParseAddr(lease.Address)
+}
+
+// Release marks the client's lease as idle. The address stays reserved for
+// the client until the lease duration has passed.
+func (p *AddressPool) Release(clientKey []byte) {
+	key := hex.EncodeToString(clientKey)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active[key]--
+	if p.active[key] > 0 {
+		return
+	}
+	delete(p.active, key)
+	if lease, ok := p.leases[key]; ok {
+		lease.Expires = time.Now().Add(p.duration)
+	}
+
+	err := p.save()
+	if err != nil {
+		log.Printf("IPAM: Failed to persist leases: %v", err)
+	}
+}
+
+// nextFree finds the lowest unused host address, reclaiming expired leases
+// of disconnected clients. The caller must hold p.mu.
+func (p *AddressPool) nextFree(now time.Time) (netip.Addr, error) {
+	inUse := make(map[netip.Addr]bool)
+	for key, lease := range p.leases {
+		addr, valid := p.leaseAddr(lease)
+		if !valid {
+			delete(p.leases, key)
+			continue
+		}
+		if p.active[key] == 0 && now.After(lease.Expires) {
+			delete(p.leases, key)
+			continue
+		}
+		inUse[addr] = true
+	}
+
+	for addr := p.prefix.Addr().Next(); p.prefix.Contains(addr); addr = addr.Next() {
+		if addr == p.gateway || inUse[addr] || p.isBroadcast(addr) || p.isReserved(addr) {
+			continue
+		}
+		return addr, nil
+	}
+	return netip.Addr{}, errors.New("address pool exhausted")
+}
+
+func (p *AddressPool) leaseAddr(lease *Lease) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(lease.Address)
+	if err != nil || !p.prefix.Contains(addr) || addr == p.gateway || p.isReserved(addr) {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+func (p *AddressPool) isReserved(addr netip.Addr) bool {
+	for _, prefix := range p.reserved {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *AddressPool) isBroadcast(addr netip.Addr) bool {
+	return addr.Is4() && !p.prefix.Contains(addr.Next())
+}
+
+func (p *AddressPool) load() error {
+	if p.path == "" || !fileExists(p.path) {
+		return nil
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	var leases []*Lease
+	err = yaml.Unmarshal(data, &leases)
+	if err != nil {
+		return fmt.Errorf("failed to parse lease file: %w", err)
+	}
+
+	for _, lease := range leases {
+		p.leases[lease.ClientKey] = lease
+	}
+	return nil
+}
+
+// save writes every lease to disk. The caller must hold p.mu.
+func (p *AddressPool) save() error {
+	if p.path == "" {
+		return nil
+	}
+
+	leases := make([]*Lease, 0, len(p.leases))
+	for _, lease := range p.leases {
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].ClientKey < leases[j].ClientKey
+	})
+
+	data, err := yaml.Marshal(leases)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Linux/server/ipam_test.go
+// Address pool and lease tests for Linux server build
+// Developer: CyberPanther232
+
+func newTestPool(t *testing.T, prefix string, path string) *AddressPool {
+	t.Helper()
+	p := netip.MustParsePrefix(prefix)
+	pool, err := newAddressPool(p, p.Addr().Next(), time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func acquire(t *testing.T, pool *AddressPool, client []byte) string {
+	t.Helper()
+	addr, err := pool.Acquire(client)
+	if err != nil {
+		t.Fatalf("Acquire(%s): %v", client, err)
+	}
+	return addr.String()
+}
+
+// expire ends the lease of client as if its duration had passed.
+func expire(pool *AddressPool, client []byte) {
+	pool.leases[hex.EncodeToString(client)].Expires = time.Now().Add(-time.Second)
+}
+
+func TestAddressPoolStickyLeases(t *testing.T) {
+	pool := newTestPool(t, "10.0.0.0/24", "")
+	alice, bob, carol := []byte("alice"), []byte("bob"), []byte("carol")
+
+	if got := acquire(t, pool, alice); got != "10.0.0.2" {
+		t.Fatalf("first lease %s, want 10.0.0.2 after the gateway", got)
+	}
+	pool.Release(alice)
+	if got := acquire(t, pool, bob); got != "10.0.0.3" {
+		t.Errorf("bob got %s, want 10.0.0.3 while alice's lease is still valid", got)
+	}
+	if got := acquire(t, pool, alice); got != "10.0.0.2" {
+		t.Errorf("returning alice got %s, want the same 10.0.0.2", got)
+	}
+
+	// A connected client keeps its address even past the lease duration
+	expire(pool, alice)
+	if got := acquire(t, pool, carol); got != "10.0.0.4" {
+		t.Errorf("carol got %s, want 10.0.0.4 while alice is connected", got)
+	}
+}
+
+func TestAddressPoolExpiry(t *testing.T) {
+	pool := newTestPool(t, "10.0.0.0/24", "")
+	alice, bob := []byte("alice"), []byte("bob")
+
+	acquire(t, pool, alice)
+	pool.Release(alice)
+	expire(pool, alice)
+	if got := acquire(t, pool, bob); got != "10.0.0.2" {
+		t.Errorf("bob got %s, want alice's expired 10.0.0.2", got)
+	}
+	if got := acquire(t, pool, alice); got != "10.0.0.3" {
+		t.Errorf("alice got %s, want a new address once the old one was reassigned", got)
+	}
+}
+
+func TestAddressPoolPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.yml")
+	alice, bob := []byte("alice"), []byte("bob")
+
+	pool := newTestPool(t, "10.0.0.0/24", path)
+	acquire(t, pool, alice)
+	acquire(t, pool, bob)
+	pool.Release(alice)
+	pool.Release(bob)
+
+	reloaded := newTestPool(t, "10.0.0.0/24", path)
+	if got := acquire(t, reloaded, bob); got != "10.0.0.3" {
+		t.Errorf("bob got %s after a restart, want 10.0.0.3", got)
+	}
+	if got := acquire(t, reloaded, []byte("carol")); got != "10.0.0.4" {
+		t.Errorf("carol got %s after a restart, want 10.0.0.4", got)
+	}
+}
+
+func TestAddressPoolExhausted(t *testing.T) {
+	// Of 10.0.0.0/30, .0 is the network, .1 the gateway and .3 broadcast
+	pool := newTestPool(t, "10.0.0.0/30", "")
+	if got := acquire(t, pool, []byte("alice")); got != "10.0.0.2" {
+		t.Fatalf("alice got %s, want 10.0.0.2", got)
+	}
+	if addr, err := pool.Acquire([]byte("bob")); err == nil {
+		t.Errorf("bob got %s from an exhausted pool", addr)
+	}
+}
+
+// Addresses routed to a peer by its AllowedAddresses are never leased, and a
+// lease on one from before it was routed is given up.
+func TestAddressPoolReserved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.yml")
+	alice, bob := []byte("alice"), []byte("bob")
+	pool := newTestPool(t, "10.0.0.0/24", path)
+	acquire(t, pool, alice)
+	pool.Release(alice)
+
+	reloaded := newTestPool(t, "10.0.0.0/24", path)
+	reloaded.Reserve([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.2/32"),
+		netip.MustParsePrefix("10.0.0.4/31"),
+		netip.MustParsePrefix("192.168.50.0/24"),
+	})
+	if got := acquire(t, reloaded, bob); got != "10.0.0.3" {
+		t.Errorf("bob got %s, want 10.0.0.3 between the reserved addresses", got)
+	}
+	if got := acquire(t, reloaded, alice); got != "10.0.0.6" {
+		t.Errorf("alice got %s, want 10.0.0.6 instead of the now reserved 10.0.0.2", got)
+	}
+}
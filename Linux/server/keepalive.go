@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Linux/server/keepalive.go
+// Keepalives and dead-peer detection for Linux server build
+// Developer: CyberPanther232
+
+const (
+	defaultKeepaliveInterval = 15 * time.Second
+	defaultPeerTimeout       = 60 * time.Second
+
+	peerMonitorTick = time.Second
+)
+
+// peerMonitor watches the traffic of one tunnel. It keeps an idle tunnel
+// alive with empty encrypted packets and notices a peer that has gone quiet,
+// which a half-open TCP connection or a lost UDP peer otherwise never reports.
+type peerMonitor struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	lastSent     atomic.Int64
+	lastReceived atomic.Int64
+}
+
+// newPeerMonitor creates a monitor that sends a keepalive after interval
+// without outgoing traffic and gives up on the peer after timeout without
+// incoming traffic. Values that are not positive disable either behaviour.
+func newPeerMonitor(interval, timeout time.Duration) *peerMonitor {
+	m := &peerMonitor{interval: interval, timeout: timeout}
+	now := time.Now().UnixNano()
+	m.lastSent.Store(now)
+	m.lastReceived.Store(now)
+	return m
+}
+
+func (m *peerMonitor) Sent() {
+	m.lastSent.Store(time.Now().UnixNano())
+}
+
+// Received records an authenticated packet from the peer. Only call it once a
+// packet has been decrypted, so forged traffic cannot keep a session alive.
+func (m *peerMonitor) Received() {
+	m.lastReceived.Store(time.Now().UnixNano())
+}
+
+// Run sends keepalives and watches for the peer timeout until done is closed.
+// onTimeout is called once if the peer goes quiet, after which Run returns.
+func (m *peerMonitor) Run(done <-chan struct{}, sendKeepalive func() error, onTimeout func()) {
+	ticker := time.NewTicker(peerMonitorTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if m.timeout > 0 && now.Sub(time.Unix(0, m.lastReceived.Load())) >= m.timeout {
+				onTimeout()
+				return
+			}
+			if m.interval > 0 && now.Sub(time.Unix(0, m.lastSent.Load())) >= m.interval {
+				// Errors surface through the receive loop or the timeout
+				sendKeepalive()
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// Linux/server/keyfile_test.go
+// Private key file encryption tests for Linux server build
+// Developer: CyberPanther232
+
+func TestPrivateKeyEncryption(t *testing.T) {
+	priv := bytes.Repeat([]byte{0x42}, 32)
+	passphrase := []byte("correct horse battery staple")
+	encrypted, err := encryptPrivateKey(priv, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedKey(encrypted) {
+		t.Fatal("encrypted key is not recognised as encrypted")
+	}
+	if bytes.Contains(encrypted, priv) {
+		t.Fatal("encrypted key file contains the key in the clear")
+	}
+
+	// Offsets into the header after the magic
+	const (
+		versionAt = len(keyFileMagic)
+		timeAt    = versionAt + 1
+		memoryAt  = timeAt + 4
+		threadsAt = memoryAt + 4
+	)
+	tests := []struct {
+		name       string
+		modify     func(data []byte) []byte
+		passphrase []byte
+		wantErr    string
+	}{
+		{
+			name:       "round trip",
+			modify:     func(data []byte) []byte { return data },
+			passphrase: passphrase,
+		},
+		{
+			name:       "wrong passphrase",
+			modify:     func(data []byte) []byte { return data },
+			passphrase: []byte("wrong"),
+			wantErr:    "wrong passphrase",
+		},
+		{
+			name:       "truncated",
+			modify:     func(data []byte) []byte { return data[:keyFileHeaderLen-1] },
+			passphrase: passphrase,
+			wantErr:    "truncated",
+		},
+		{
+			name: "unsupported version",
+			modify: func(data []byte) []byte {
+				data[versionAt] = keyFileVersion + 1
+				return data
+			},
+			passphrase: passphrase,
+			wantErr:    "unsupported key file version",
+		},
+		{
+			name: "weakened parameters",
+			modify: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[timeAt:], 1)
+				return data
+			},
+			passphrase: passphrase,
+			wantErr:    "wrong passphrase",
+		},
+		{
+			name: "tampered sealed key",
+			modify: func(data []byte) []byte {
+				data[len(data)-1] ^= 1
+				return data
+			},
+			passphrase: passphrase,
+			wantErr:    "wrong passphrase",
+		},
+		{
+			name: "zero time",
+			modify: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[timeAt:], 0)
+				return data
+			},
+			passphrase: passphrase,
+			wantErr:    "invalid argon2id parameters",
+		},
+		{
+			name: "time above limit",
+			modify: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[timeAt:], keyFileMaxTime+1)
+				return data
+			},
+			passphrase: passphrase,
+			wantErr:    "invalid argon2id parameters",
+		},
+		{
+			name: "zero memory",
+			modify: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[memoryAt:], 0)
+				return data
+			},
+			passphrase: passphrase,
+			wantErr:    "invalid argon2id parameters",
+		},
+		{
+			name: "memory above limit",
+			modify: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[memoryAt:], keyFileMaxMemory+1)
+				return data
+			},
+			passphrase: passphrase,
+			wantErr:    "invalid argon2id parameters",
+		},
+		{
+			name: "zero threads",
+			modify: func(data []byte) []byte {
+				data[threadsAt] = 0
+				return data
+			},
+			passphrase: passphrase,
+			wantErr:    "invalid argon2id parameters",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.modify(bytes.Clone(encrypted))
+			got, err := decryptPrivateKey(data, tt.passphrase)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, priv) {
+				t.Errorf("decrypted %x, want %x", got, priv)
+			}
+		})
+	}
+}
+
+func TestEncryptPrivateKeyUsesFreshSalt(t *testing.T) {
+	priv := bytes.Repeat([]byte{0x42}, 32)
+	a, err := encryptPrivateKey(priv, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encryptPrivateKey(priv, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, b) {
+		t.Error("two encryptions of the same key are identical")
+	}
+}
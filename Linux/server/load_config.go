@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
@@ -17,9 +18,79 @@ import (
 type ServerConfig struct {
 	Address        string `yaml:"Address"`
 	Port           int    `yaml:"Port"`
+	Transport      string `yaml:"Transport"`
 	PrivateKeyFile string `yaml:"PrivateKeyFile"`
+	// Protect a newly generated private key with a passphrase
+	EncryptPrivateKey bool `yaml:"EncryptPrivateKey"`
+	// How long the key replaced by the rotate command stays valid
+	KeyGracePeriod time.Duration `yaml:"KeyGracePeriod"`
+
+	// Noise patterns clients may use (XX, IK, XXpsk3, IKpsk2). The psk
+	// variants mix in a key from PresharedKeyFile, or from the peer's own
+	// file in the authorized peers list. An XXpsk3 handshake may try up to
+	// PresharedKeyTries of those keys, or any number if it is negative
+	HandshakePatterns []string `yaml:"HandshakePatterns"`
+	PresharedKeyFile  string   `yaml:"PresharedKeyFile"`
+	PresharedKeyTries int      `yaml:"PresharedKeyTries"`
+
+	// Require clients to add ML-KEM-768 to the handshake. Clients must be
+	// configured the same way or the handshake is refused
+	PostQuantum bool `yaml:"PostQuantum"`
+
+	// Cipher suites clients may encrypt with, e.g. ChaChaPoly_BLAKE2s for
+	// clients without AES acceleration
+	CipherSuites []string `yaml:"CipherSuites"`
+
+	// MTU of the tunnel interface; clients are told to use at most this
+	MTU int `yaml:"MTU"`
+
+	// Answer packets with no matching route with ICMP unreachable
+	// instead of silently dropping them
+	SendUnreachable bool `yaml:"SendUnreachable"`
+
+	// Client address pool, e.g. 10.0.0.0/24. Address must be inside it
+	AddressPool   string        `yaml:"AddressPool"`
+	LeaseDuration time.Duration `yaml:"LeaseDuration"`
+	LeaseFile     string        `yaml:"LeaseFile"`
+
+	// Where the latest handshake timestamp of every client is kept, so
+	// replayed handshakes are refused across restarts
+	TimestampFile string `yaml:"TimestampFile"`
+
+	// Clients allowed to connect, keyed by static public key
+	AuthorizedPeersFile string `yaml:"AuthorizedPeersFile"`
+	// Ed25519 public keys of the CAs whose certificates also admit clients,
+	// hex or base64
+	CAPublicKeys []string `yaml:"CAPublicKeys"`
+	// Revocation list signed by one of the CAs, naming client keys refused
+	// despite an authorized peers entry or certificate. Reloaded on change
+	RevokedKeysFile string `yaml:"RevokedKeysFile"`
+
+	// Move each session to a fresh key after this long or this many bytes,
+	// whichever comes first. A negative interval or byte count disables it
+	RekeyInterval time.Duration `yaml:"RekeyInterval"`
+	RekeyBytes    int64         `yaml:"RekeyBytes"`
+
+	// Handshake flood protection. Each source IP may start HandshakeRate
+	// handshakes per second, in bursts of up to HandshakeBurst, and have as
+	// many waiting to start. Once more than HandshakeLoad handshakes are in
+	// progress, UDP clients must first echo a cookie sent to their address.
+	// A negative rate or load disables either. Every handshake must finish
+	// within HandshakeTimeout
+	HandshakeRate    float64       `yaml:"HandshakeRate"`
+	HandshakeBurst   int           `yaml:"HandshakeBurst"`
+	HandshakeLoad    int           `yaml:"HandshakeLoad"`
+	HandshakeTimeout time.Duration `yaml:"HandshakeTimeout"`
+
+	// Send a keepalive after KeepaliveInterval without outgoing traffic and
+	// drop a session after PeerTimeout without incoming traffic. A negative
+	// value disables either
+	KeepaliveInterval time.Duration `yaml:"KeepaliveInterval"`
+	PeerTimeout       time.Duration `yaml:"PeerTimeout"`
 }
 
+const defaultMTU = 1500
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
@@ -42,15 +113,76 @@ func loadServerConfig(path string) (*ServerConfig, error) {
 		return nil, err
 	}
 
+	if config.Transport == "" {
+		config.Transport = defaultTransport
+	}
+	if config.PrivateKeyFile == "" {
+		config.PrivateKeyFile = "server.key"
+	}
+	if config.KeyGracePeriod == 0 {
+		config.KeyGracePeriod = defaultKeyGracePeriod
+	}
+	if len(config.HandshakePatterns) == 0 {
+		config.HandshakePatterns = []string{"XX", "IK"}
+	}
+	if config.PresharedKeyTries == 0 {
+		config.PresharedKeyTries = defaultPresharedKeyTries
+	}
+	if len(config.CipherSuites) == 0 {
+		config.CipherSuites = cipherSuiteNames()
+	}
+	if config.MTU == 0 {
+		config.MTU = defaultMTU
+	}
+	if config.AddressPool == "" {
+		config.AddressPool = config.Address + "/24"
+	}
+	if config.LeaseDuration == 0 {
+		config.LeaseDuration = 24 * time.Hour
+	}
+	if config.LeaseFile == "" {
+		config.LeaseFile = "leases.yml"
+	}
+	if config.TimestampFile == "" {
+		config.TimestampFile = "timestamps.yml"
+	}
+	if config.AuthorizedPeersFile == "" {
+		config.AuthorizedPeersFile = "authorized_peers.yml"
+	}
+	if config.RekeyInterval == 0 {
+		config.RekeyInterval = defaultRekeyInterval
+	}
+	if config.RekeyBytes == 0 {
+		config.RekeyBytes = defaultRekeyBytes
+	}
+	if config.HandshakeRate == 0 {
+		config.HandshakeRate = defaultHandshakeRate
+	}
+	if config.HandshakeBurst == 0 {
+		config.HandshakeBurst = defaultHandshakeBurst
+	}
+	if config.HandshakeLoad == 0 {
+		config.HandshakeLoad = defaultHandshakeLoad
+	}
+	if config.HandshakeTimeout <= 0 {
+		config.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if config.KeepaliveInterval == 0 {
+		config.KeepaliveInterval = defaultKeepaliveInterval
+	}
+	if config.PeerTimeout == 0 {
+		config.PeerTimeout = defaultPeerTimeout
+	}
+
 	return config, nil
 }
 
-func saveKey(key noise.DHKey) error {
-	return os.WriteFile("server.key", key.Private, 0600)
+func saveKey(path string, key noise.DHKey, encrypt bool) error {
+	return writeKeyFile(path, key.Private, encrypt)
 }
 
-func loadKey() (noise.DHKey, error) {
-	priv, err := os.ReadFile("server.key")
+func loadKey(path string) (noise.DHKey, error) {
+	priv, err := readKeyFile(path)
 	if err != nil {
 		return noise.DHKey{}, err
 	}
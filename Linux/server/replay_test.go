@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+// Linux/server/replay_test.go
+// Replay protection tests for Linux server build
+// Developer: CyberPanther232
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		accepted []uint64
+		counter  uint64
+		want     bool
+	}{
+		{"first packet", nil, 0, true},
+		{"replayed first packet", []uint64{0}, 0, false},
+		{"next in order", []uint64{0, 1, 2}, 3, true},
+		{"replayed in order", []uint64{0, 1, 2}, 1, false},
+		{"late but unseen", []uint64{0, 2, 3}, 1, true},
+		{"gap across blocks", []uint64{5, 200}, 100, true},
+		{"replay across blocks", []uint64{5, 100, 200}, 100, false},
+		{"oldest inside window", []uint64{replayWindowSize}, 1, true},
+		{"just outside window", []uint64{replayWindowSize}, 0, false},
+		{"far behind after jump", []uint64{0, 1 << 20}, 1, false},
+		{"stale bits cleared on wrap", []uint64{70, 2100, 2120}, 2118, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w replayWindow
+			for _, counter := range tt.accepted {
+				if !w.Check(counter) {
+					t.Fatalf("Check(%d) rejected a fresh counter while filling the window", counter)
+				}
+				w.Accept(counter)
+			}
+			if got := w.Check(tt.counter); got != tt.want {
+				t.Errorf("Check(%d) = %v, want %v", tt.counter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayWindowCheckDoesNotRecord(t *testing.T) {
+	var w replayWindow
+	if !w.Check(7) || !w.Check(7) {
+		t.Fatal("Check recorded a counter it was only asked about")
+	}
+	w.Accept(7)
+	if w.Check(7) {
+		t.Fatal("Check accepted a counter after Accept")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Linux/server/revocation.go
+// Client key revocation for Linux server build
+// Developer: CyberPanther232
+
+// A revocation list names client keys that must not connect, whether they are
+// in the authorized peers list or hold a valid certificate. It is signed by a
+// CA key like a certificate, so it can be handed around and dropped into
+// place without trusting the channel it came through. Every list carries a
+// serial that grows with each change, and a server never goes back to a list
+// older than the one it has.
+const revocationListVersion = 1
+
+const revocationListContext = "burrow revocation list\x00"
+
+// How often the server looks for a changed revocation list
+const revocationCheckInterval = 5 * time.Second
+
+type RevocationList struct {
+	Version int       `json:"version"`
+	Serial  uint64    `json:"serial"`
+	Issued  time.Time `json:"issued"`
+	Revoked []string  `json:"revoked"` // key fingerprints, SHA256:...
+
+	revoked map[string]bool
+}
+
+// SignedRevocationList is the form a revocation list is stored in.
+type SignedRevocationList struct {
+	Body      []byte `json:"revocation_list"`
+	Signature []byte `json:"signature"`
+}
+
+func (l *RevocationList) Contains(key []byte) bool {
+	return l.revoked[fingerprint(key)]
+}
+
+func signRevocationList(list *RevocationList, ca ed25519.PrivateKey) ([]byte, error) {
+	body, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	signature := ed25519.Sign(ca, append([]byte(revocationListContext), body...))
+	return json.MarshalIndent(&SignedRevocationList{Body: body, Signature: signature}, "", "  ")
+}
+
+// parseRevocationList checks that a revocation list was signed by one of the
+// trusted CA keys and decodes it.
+func parseRevocationList(data []byte, cas []ed25519.PublicKey) (*RevocationList, error) {
+	var signed SignedRevocationList
+	err := json.Unmarshal(data, &signed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revocation list: %w", err)
+	}
+	message := append([]byte(revocationListContext), signed.Body...)
+	trusted := false
+	for _, ca := range cas {
+		if ed25519.Verify(ca, message, signed.Signature) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return nil, errors.New("revocation list is not signed by a trusted CA")
+	}
+
+	var list RevocationList
+	err = json.Unmarshal(signed.Body, &list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revocation list: %w", err)
+	}
+	if list.Version != revocationListVersion {
+		return nil, fmt.Errorf("unsupported revocation list version %d", list.Version)
+	}
+	list.revoked = make(map[string]bool, len(list.Revoked))
+	for _, entry := range list.Revoked {
+		list.revoked[entry] = true
+	}
+	return &list, nil
+}
+
+func loadRevocationList(path string, cas []ed25519.PublicKey) (*RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRevocationList(data, cas)
+}
+
+// revokeKeys adds keys to the revocation list at path, creating it if needed,
+// and signs the result with the next serial.
+func revokeKeys(path string, ca ed25519.PrivateKey, keys []string) (*RevocationList, error) {
+	list, err := loadRevocationList(path, []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)})
+	if errors.Is(err, os.ErrNotExist) {
+		list, err = &RevocationList{Version: revocationListVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		entry, err := parseRevokedKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if !list.revoked[entry] {
+			list.Revoked = append(list.Revoked, entry)
+		}
+	}
+	list.Serial++
+	list.Issued = time.Now().UTC().Truncate(time.Second)
+
+	data, err := signRevocationList(list, ca)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return list, os.Rename(tmp, path)
+}
+
+// parseRevokedKey accepts a key fingerprint as printed in the logs or the
+// public key itself, and returns the fingerprint.
+func parseRevokedKey(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if digest, ok := strings.CutPrefix(s, "SHA256:"); ok {
+		sum, err := base64.RawStdEncoding.DecodeString(digest)
+		if err != nil || len(sum) != 32 {
+			return "", fmt.Errorf("invalid key fingerprint %q", s)
+		}
+		return s, nil
+	}
+	key, ok := decodeKey(s)
+	if !ok {
+		return "", fmt.Errorf("expected a key fingerprint or public key, got %q", s)
+	}
+	return fingerprint(key), nil
+}
+
+// isRevoked reports whether a client key is on the current revocation list.
+func (srv *Server) isRevoked(key []byte) bool {
+	list := srv.revoked.Load()
+	return list != nil && list.Contains(key)
+}
+
+// watchRevocations reloads the revocation list whenever the file changes and
+// closes the sessions of clients it newly revokes. A list that fails to
+// verify or is older than the current one is ignored, and the current list
+// stays in force.
+func (srv *Server) watchRevocations() {
+	path := srv.config.RevokedKeysFile
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Revocations: %v\n", err)
+	}
+	var modified time.Time
+	if info != nil {
+		modified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(revocationCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+
+		list, err := loadRevocationList(path, srv.cas)
+		if err != nil {
+			log.Printf("Revocations: Keeping the current list: %v\n", err)
+			continue
+		}
+		current := srv.revoked.Load()
+		if list.Serial < current.Serial {
+			log.Printf("Revocations: Ignoring list %d, which is older than the current list %d\n", list.Serial, current.Serial)
+			continue
+		}
+		srv.revoked.Store(list)
+		log.Printf("Revocations: Loaded list %d with %d revoked keys\n", list.Serial, len(list.Revoked))
+
+		for _, session := range srv.sessions.Snapshot() {
+			if list.Contains(session.PeerKey) {
+				log.Printf("Session %d: Client key %s was revoked, closing\n", session.ID, fingerprint(session.PeerKey))
+				srv.routes.RemoveSession(session)
+				session.Disconnect("client key revoked")
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Linux/server/revocation_test.go
+// Client key revocation tests for Linux server build
+// Developer: CyberPanther232
+
+func TestParseRevocationList(t *testing.T) {
+	ca := testCAKey(t, 1)
+	otherCA := testCAKey(t, 2)
+	revokedKey := bytes.Repeat([]byte{0xcc}, 32)
+	keptKey := bytes.Repeat([]byte{0xdd}, 32)
+
+	sign := func(t *testing.T, list *RevocationList, key ed25519.PrivateKey) []byte {
+		t.Helper()
+		data, err := signRevocationList(list, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	newList := func() *RevocationList {
+		return &RevocationList{Version: revocationListVersion, Serial: 3, Revoked: []string{fingerprint(revokedKey)}}
+	}
+
+	tests := []struct {
+		name    string
+		data    func(t *testing.T) []byte
+		wantErr string
+	}{
+		{
+			name: "valid",
+			data: func(t *testing.T) []byte { return sign(t, newList(), ca) },
+		},
+		{
+			name:    "untrusted CA",
+			data:    func(t *testing.T) []byte { return sign(t, newList(), otherCA) },
+			wantErr: "not signed by a trusted CA",
+		},
+		{
+			name: "certificate signature does not carry over",
+			data: func(t *testing.T) []byte {
+				body, _ := json.Marshal(newList())
+				signature := ed25519.Sign(ca, append([]byte(certificateContext), body...))
+				data, _ := json.Marshal(&SignedRevocationList{Body: body, Signature: signature})
+				return data
+			},
+			wantErr: "not signed by a trusted CA",
+		},
+		{
+			name: "unsupported version",
+			data: func(t *testing.T) []byte {
+				list := newList()
+				list.Version = revocationListVersion + 1
+				return sign(t, list, ca)
+			},
+			wantErr: "unsupported revocation list version",
+		},
+		{
+			name:    "not a revocation list",
+			data:    func(t *testing.T) []byte { return []byte("{") },
+			wantErr: "invalid revocation list",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := parseRevocationList(tt.data(t), []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if list.Serial != 3 {
+				t.Errorf("got serial %d, want 3", list.Serial)
+			}
+			if !list.Contains(revokedKey) {
+				t.Error("list does not contain the revoked key")
+			}
+			if list.Contains(keptKey) {
+				t.Error("list contains a key that was not revoked")
+			}
+		})
+	}
+}
+
+func TestRevokeKeys(t *testing.T) {
+	ca := testCAKey(t, 1)
+	first := bytes.Repeat([]byte{0x11}, 32)
+	second := bytes.Repeat([]byte{0x22}, 32)
+	path := filepath.Join(t.TempDir(), "revoked.json")
+
+	list, err := revokeKeys(path, ca, []string{hex.EncodeToString(first)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Serial != 1 {
+		t.Errorf("first list has serial %d, want 1", list.Serial)
+	}
+
+	// Revoking again by fingerprint adds nothing, but still moves the serial on
+	list, err = revokeKeys(path, ca, []string{fingerprint(first), hex.EncodeToString(second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Serial != 2 || len(list.Revoked) != 2 {
+		t.Errorf("second list has serial %d and %d entries, want 2 and 2", list.Serial, len(list.Revoked))
+	}
+
+	loaded, err := loadRevocationList(path, []ed25519.PublicKey{ca.Public().(ed25519.PublicKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Contains(first) || !loaded.Contains(second) {
+		t.Error("stored list lost a revoked key")
+	}
+
+	if _, err := revokeKeys(path, ca, []string{"not a key"}); err == nil {
+		t.Error("revokeKeys accepted an invalid key")
+	}
+}
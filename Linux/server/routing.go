@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// Linux/server/routing.go
+// Destination routing table for Linux server build
+// Developer: CyberPanther232
+
+// RoutingTable maps inner destination prefixes to the session that owns them.
+// Lookups pick the longest matching prefix across both IPv4 and IPv6.
+type RoutingTable struct {
+	mu       sync.RWMutex
+	routes   map[netip.Prefix]*Session
+	lengths4 []int // prefix lengths in use, longest first
+	lengths6 []int
+}
+
+func newRoutingTable() *RoutingTable {
+	return &RoutingTable{
+		routes: make(map[netip.Prefix]*Session),
+	}
+}
+
+// Add installs a route for prefix. It refuses to replace a route owned by a
+// different session and reports whether the route is now held by s.
+func (t *RoutingTable) Add(prefix netip.Prefix, s *Session) bool {
+	prefix = prefix.Masked()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if owner, ok := t.routes[prefix]; ok {
+		return owner == s
+	}
+	t.routes[prefix] = s
+	t.rebuildLengths()
+	return true
+}
+
+// RemoveSession drops every route owned by s.
+func (t *RoutingTable) RemoveSession(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for prefix, owner := range t.routes {
+		if owner == s {
+			delete(t.routes, prefix)
+		}
+	}
+	t.rebuildLengths()
+}
+
+// Owner returns the session holding exactly prefix, without falling back to
+// a shorter covering route.
+func (t *RoutingTable) Owner(prefix netip.Prefix) (*Session, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s, ok := t.routes[prefix.Masked()]
+	return s, ok
+}
+
+func (t *RoutingTable) Lookup(addr netip.Addr) (*Session, bool) {
+	addr = addr.Unmap()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	lengths := t.lengths6
+	if addr.Is4() {
+		lengths = t.lengths4
+	}
+	for _, bits := range lengths {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if s, ok := t.routes[prefix]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func (t *RoutingTable) rebuildLengths() {
+	seen4 := make(map[int]bool)
+	seen6 := make(map[int]bool)
+	t.lengths4 = t.lengths4[:0]
+	t.lengths6 = t.lengths6[:0]
+
+	for prefix := range t.routes {
+		bits := prefix.Bits()
+		if prefix.Addr().Is4() {
+			if !seen4[bits] {
+				seen4[bits] = true
+				t.lengths4 = append(t.lengths4, bits)
+			}
+		} else if !seen6[bits] {
+			seen6[bits] = true
+			t.lengths6 = append(t.lengths6, bits)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lengths4)))
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lengths6)))
+}
+
+func hostPrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// packetSource and packetDestination pull the inner addresses out of a raw
+// IPv4 or IPv6 packet read from, or destined for, the TUN device.
+func packetSource(packet []byte) (netip.Addr, bool) {
+	switch ipVersion(packet) {
+	case 4:
+		if len(packet) < 20 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom4([4]byte(packet[12:16])), true
+	case 6:
+		if len(packet) < 40 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom16([16]byte(packet[8:24])), true
+	}
+	return netip.Addr{}, false
+}
+
+func packetDestination(packet []byte) (netip.Addr, bool) {
+	switch ipVersion(packet) {
+	case 4:
+		if len(packet) < 20 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom4([4]byte(packet[16:20])), true
+	case 6:
+		if len(packet) < 40 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom16([16]byte(packet[24:40])), true
+	}
+	return netip.Addr{}, false
+}
+
+func ipVersion(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	return int(packet[0] >> 4)
+}
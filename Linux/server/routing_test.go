@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// Linux/server/routing_test.go
+// Destination routing table tests for Linux server build
+// Developer: CyberPanther232
+
+func TestRoutingTableLookup(t *testing.T) {
+	routes := []struct {
+		prefix  string
+		session uint64
+	}{
+		{"10.8.0.0/24", 1},
+		{"10.8.0.5/32", 2},
+		{"10.8.0.0/16", 3},
+		{"192.168.1.0/24", 2},
+		{"0.0.0.0/0", 4},
+		{"fd00::/64", 5},
+		{"fd00::5/128", 6},
+	}
+	table := newRoutingTable()
+	sessions := make(map[uint64]*Session)
+	for _, route := range routes {
+		s, ok := sessions[route.session]
+		if !ok {
+			s = &Session{ID: route.session}
+			sessions[route.session] = s
+		}
+		if !table.Add(netip.MustParsePrefix(route.prefix), s) {
+			t.Fatalf("Add(%s) refused a free prefix", route.prefix)
+		}
+	}
+
+	tests := []struct {
+		addr    string
+		session uint64 // 0 for no route
+	}{
+		{"10.8.0.5", 2},
+		{"10.8.0.6", 1},
+		{"10.8.1.1", 3},
+		{"192.168.1.200", 2},
+		{"8.8.8.8", 4},
+		{"::ffff:10.8.0.5", 2},
+		{"fd00::5", 6},
+		{"fd00::6", 5},
+		{"fd00:0:0:1::1", 0},
+		{"2001:db8::1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			s, ok := table.Lookup(netip.MustParseAddr(tt.addr))
+			if tt.session == 0 {
+				if ok {
+					t.Fatalf("Lookup found session %d, want no route", s.ID)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Lookup found no route, want session %d", tt.session)
+			}
+			if s.ID != tt.session {
+				t.Errorf("Lookup found session %d, want %d", s.ID, tt.session)
+			}
+		})
+	}
+}
+
+func TestRoutingTableOwnership(t *testing.T) {
+	first := &Session{ID: 1}
+	second := &Session{ID: 2}
+	table := newRoutingTable()
+	table.Add(netip.MustParsePrefix("10.8.0.0/24"), first)
+	table.Add(netip.MustParsePrefix("10.8.0.2/32"), first)
+
+	tests := []struct {
+		name    string
+		prefix  string
+		session *Session
+		want    bool
+	}{
+		{"same owner again", "10.8.0.0/24", first, true},
+		{"taken by another session", "10.8.0.0/24", second, false},
+		{"unmasked form of a taken prefix", "10.8.0.9/24", second, false},
+		{"overlapping longer prefix", "10.8.0.128/25", second, true},
+		{"overlapping shorter prefix", "10.0.0.0/8", second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := table.Add(netip.MustParsePrefix(tt.prefix), tt.session); got != tt.want {
+				t.Errorf("Add(%s) = %v, want %v", tt.prefix, got, tt.want)
+			}
+		})
+	}
+
+	if s, ok := table.Owner(netip.MustParsePrefix("10.8.0.2/32")); !ok || s != first {
+		t.Error("Owner did not return the session holding the host route")
+	}
+	if _, ok := table.Owner(netip.MustParsePrefix("10.8.0.3/32")); ok {
+		t.Error("Owner fell back to a covering route")
+	}
+
+	table.RemoveSession(first)
+	if s, ok := table.Lookup(netip.MustParseAddr("10.8.0.2")); !ok || s != second {
+		t.Error("Lookup did not fall back to the remaining covering route after RemoveSession")
+	}
+	if s, ok := table.Lookup(netip.MustParseAddr("10.8.0.200")); !ok || s != second {
+		t.Error("Lookup lost the overlapping route of another session after RemoveSession")
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Linux/server/server.go
+// Shared server state for Linux server build
+// Developer: CyberPanther232
+
+// Server ties together the TUN device, the server identity and the tables
+// every session goroutine needs to consult.
+type Server struct {
+	config   *ServerConfig
+	dev      tun.Device
+	keys     atomic.Pointer[serverKeySet] // replaced by watchNextKey
+	gateway  netip.Addr
+	patterns []*handshakePattern
+	suites   []*cipherSuite
+
+	sessions   *SessionRegistry
+	routes     *RoutingTable
+	pool       *AddressPool
+	timestamps *HandshakeTimestamps
+	peers      *AuthorizedPeers
+	cas        []ed25519.PublicKey
+	revoked    atomic.Pointer[RevocationList] // nil without RevokedKeysFile
+	guard      *handshakeGuard
+
+	// Handlers for control messages from clients, keyed by kind
+	control map[string]controlHandler
+}
+
+type controlHandler func(session *Session, body json.RawMessage) error
+
+// serverKeySet holds the keys handshakes are accepted on, current key first,
+// and the public key of the next rotation if one is prepared. A key prepared
+// while the server runs replaces the whole set.
+type serverKeySet struct {
+	keys []noise.DHKey
+	next []byte
+}
+
+func newServer(config *ServerConfig, dev tun.Device, serverKeys []noise.DHKey, nextKey []byte) (*Server, error) {
+	gateway, err := netip.ParseAddr(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address: %w", err)
+	}
+	prefix, err := netip.ParsePrefix(config.AddressPool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address pool: %w", err)
+	}
+
+	var patterns []*handshakePattern
+	usesPSK := false
+	for _, name := range config.HandshakePatterns {
+		pattern, err := lookupHandshakePattern(name)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+		usesPSK = usesPSK || pattern.UsesPSK()
+	}
+	var suites []*cipherSuite
+	for _, name := range config.CipherSuites {
+		cs, err := lookupCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, cs)
+	}
+	if config.PostQuantum {
+		log.Printf("Accepting handshake patterns %v with cipher suites %v and ML-KEM-768\n", config.HandshakePatterns, config.CipherSuites)
+	} else {
+		log.Printf("Accepting handshake patterns %v with cipher suites %v\n", config.HandshakePatterns, config.CipherSuites)
+	}
+
+	pool, err := newAddressPool(prefix, gateway, config.LeaseDuration, config.LeaseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamps, err := loadHandshakeTimestamps(config.TimestampFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []ed25519.PublicKey
+	for _, s := range config.CAPublicKeys {
+		key, err := parsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA public key: %w", err)
+		}
+		cas = append(cas, ed25519.PublicKey(key))
+	}
+	if len(cas) > 0 {
+		log.Printf("Accepting certificates from %d CAs\n", len(cas))
+	}
+
+	peers, err := loadAuthorizedPeers(config.AuthorizedPeersFile, len(cas) > 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load authorized peers: %w", err)
+	}
+	log.Printf("Loaded %d authorized peers from %s\n", peers.Count(), config.AuthorizedPeersFile)
+	pool.Reserve(peers.AllowedPrefixes())
+
+	var revoked *RevocationList
+	if config.RevokedKeysFile != "" {
+		if len(cas) == 0 {
+			return nil, errors.New("RevokedKeysFile needs CAPublicKeys to check its signature")
+		}
+		revoked, err = loadRevocationList(config.RevokedKeysFile, cas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load revocation list: %w", err)
+		}
+		log.Printf("Loaded revocation list %d with %d revoked keys from %s\n", revoked.Serial, len(revoked.Revoked), config.RevokedKeysFile)
+	}
+
+	// Key files are read again on every handshake so they can be rotated
+	// while the server runs; this only catches mistakes early
+	keyFiles := peers.PresharedKeyFiles()
+	if config.PresharedKeyFile != "" {
+		keyFiles = append(keyFiles, config.PresharedKeyFile)
+	}
+	for _, path := range keyFiles {
+		_, err = loadPresharedKeys(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load pre-shared keys: %w", err)
+		}
+	}
+	if usesPSK && len(keyFiles) == 0 {
+		return nil, errors.New("psk handshake patterns need a PresharedKeyFile")
+	}
+	if !usesPSK && len(keyFiles) > 0 {
+		return nil, errors.New("PresharedKeyFile is set but no psk handshake pattern is accepted")
+	}
+
+	srv := &Server{
+		config:     config,
+		dev:        dev,
+		gateway:    gateway,
+		patterns:   patterns,
+		suites:     suites,
+		sessions:   newSessionRegistry(),
+		routes:     newRoutingTable(),
+		pool:       pool,
+		timestamps: timestamps,
+		peers:      peers,
+		cas:        cas,
+		guard:      newHandshakeGuard(config.HandshakeRate, config.HandshakeBurst, config.HandshakeLoad),
+		control:    make(map[string]controlHandler),
+	}
+	srv.keys.Store(&serverKeySet{keys: serverKeys, next: nextKey})
+	srv.revoked.Store(revoked)
+	return srv, nil
+}
+
+func (srv *Server) handshakeOptions() handshakeOptions {
+	return handshakeOptions{
+		Patterns:          srv.patterns,
+		CipherSuites:      srv.suites,
+		Hybrid:            srv.config.PostQuantum,
+		PresharedKeys:     srv.presharedKeys,
+		PresharedKeyTries: srv.config.PresharedKeyTries,
+		Guard:             srv.guard,
+		Timeout:           srv.config.HandshakeTimeout,
+		Transport:         srv.config.Transport,
+	}
+}
+
+// authorizePeer decides whether a client may connect, by its entry in the
+// authorized peers file or else by a certificate from a trusted CA. Revoked
+// keys are refused either way, and so is a peer with its own pre-shared key
+// that connects without one.
+func (srv *Server) authorizePeer(peerStatic []byte, hello *ClientHello, mode handshakeMode, remote net.Addr) (*AuthorizedPeer, error) {
+	if srv.isRevoked(peerStatic) {
+		log.Printf("Refused revoked client key %s from %s\n", fingerprint(peerStatic), remote)
+		return nil, errors.New("client key is revoked")
+	}
+
+	if peer, ok := srv.peers.Lookup(peerStatic); ok {
+		if !peer.IsEnabled() {
+			log.Printf("Refused disabled client %q (%s) from %s\n", peer.Name, fingerprint(peerStatic), remote)
+			return nil, errors.New("client is disabled")
+		}
+		if peer.PresharedKeyFile != "" && !mode.Pattern.UsesPSK() {
+			log.Printf("Refused client %q (%s) from %s: it has a pre-shared key but used %s\n", peer.Name, fingerprint(peerStatic), remote, mode.Pattern.Name)
+			return nil, errors.New("client must use a psk handshake pattern")
+		}
+		return peer, nil
+	}
+	if hello.Certificate == nil || len(srv.cas) == 0 {
+		log.Printf("Refused unknown client key %s from %s\n", fingerprint(peerStatic), remote)
+		return nil, errors.New("client key is not authorized")
+	}
+
+	cert, err := verifyCertificate(hello.Certificate, srv.cas, peerStatic, time.Now())
+	if err != nil {
+		log.Printf("Refused client key %s from %s: %v\n", fingerprint(peerStatic), remote, err)
+		return nil, err
+	}
+	peer, err := peerFromCertificate(cert)
+	if err != nil {
+		return nil, fmt.Errorf("certificate: %w", err)
+	}
+	log.Printf("Client %q (%s) admitted by certificate valid until %s, groups %v\n", peer.Name, fingerprint(peerStatic), cert.NotAfter.Format(time.RFC3339), peer.Groups)
+	return peer, nil
+}
+
+// presharedKeys returns the keys a client may use in a psk handshake: its own
+// PresharedKeyFile if it has one and the server-wide file otherwise. Before
+// the client is known every configured key is a candidate.
+func (srv *Server) presharedKeys(peerStatic []byte) [][]byte {
+	var paths []string
+	if peerStatic == nil {
+		paths = srv.peers.PresharedKeyFiles()
+	} else if peer, ok := srv.peers.Lookup(peerStatic); ok && peer.PresharedKeyFile != "" {
+		paths = []string{peer.PresharedKeyFile}
+	}
+	if srv.config.PresharedKeyFile != "" && (peerStatic == nil || len(paths) == 0) {
+		paths = append(paths, srv.config.PresharedKeyFile)
+	}
+
+	var keys [][]byte
+	for _, path := range paths {
+		loaded, err := loadPresharedKeys(path)
+		if err != nil {
+			log.Printf("Failed to load pre-shared keys: %v\n", err)
+			continue
+		}
+		keys = append(keys, loaded...)
+	}
+	return keys
+}
+
+// announceKeys tells a client which server keys to pin, so a rotation does
+// not lock it out.
+func (srv *Server) announceKeys(session *Session) error {
+	set := srv.keys.Load()
+	keys := ServerKeys{Current: hex.EncodeToString(set.keys[0].Public)}
+	if set.next != nil {
+		keys.Next = hex.EncodeToString(set.next)
+	}
+	return session.SendControl(controlServerKeys, &keys)
+}
+
+const nextKeyCheckInterval = 5 * time.Second
+
+// watchNextKey picks up a key prepared with nextkey while the server runs.
+// Handshakes are accepted on it from then on, and every connected client that
+// takes key announcements is told to pin it. A key that fails to load is
+// logged and read again once the file changes.
+func (srv *Server) watchNextKey() {
+	path := nextKeyPath(srv.config.PrivateKeyFile)
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(nextKeyCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+
+		next, err := loadKey(path)
+		if err != nil {
+			log.Printf("Next key: %v\n", err)
+			continue
+		}
+		if !srv.addNextKey(next) {
+			continue
+		}
+		log.Printf("Announcing next key %x (%s)\n", next.Public, fingerprint(next.Public))
+
+		for _, session := range srv.sessions.Snapshot() {
+			if !slices.Contains(session.Features, featureServerKeys) {
+				continue
+			}
+			err = srv.announceKeys(session)
+			if err != nil {
+				log.Printf("Session %d: Failed to announce server keys: %v\n", session.ID, err)
+			}
+		}
+	}
+}
+
+// addNextKey makes next the key of the next rotation, in place of any key
+// prepared before it. It reports false if next is already that key.
+func (srv *Server) addNextKey(next noise.DHKey) bool {
+	current := srv.keys.Load()
+	if bytes.Equal(current.next, next.Public) || bytes.Equal(current.keys[0].Public, next.Public) {
+		return false
+	}
+	keys := []noise.DHKey{current.keys[0], next}
+	for _, key := range current.keys[1:] {
+		if !bytes.Equal(key.Public, current.next) {
+			keys = append(keys, key)
+		}
+	}
+	srv.keys.Store(&serverKeySet{keys: keys, next: next.Public})
+	return true
+}
+
+func (srv *Server) Close() {
+	for _, session := range srv.sessions.Snapshot() {
+		srv.routes.RemoveSession(session)
+		session.Disconnect("server shutting down")
+	}
+	srv.sessions.CloseAll()
+}
+
+// writeTUN hands a single packet to the TUN device, reserving the headroom the
+// platform driver expects in front of it.
+func (srv *Server) writeTUN(packet []byte) error {
+	buf := make([]byte, tunOffset+len(packet))
+	copy(buf[tunOffset:], packet)
+	_, err := srv.dev.Write([][]byte{buf}, tunOffset)
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// Linux/server/server_test.go
+// Server key announcement tests for Linux server build
+// Developer: CyberPanther232
+
+func publicKeys(keys []noise.DHKey) []string {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = fingerprint(key.Public)
+	}
+	return names
+}
+
+func TestAddNextKey(t *testing.T) {
+	current, previous := generateTestKey(t), generateTestKey(t)
+	first, second := generateTestKey(t), generateTestKey(t)
+	srv := &Server{}
+	srv.keys.Store(&serverKeySet{keys: []noise.DHKey{current, previous}})
+
+	steps := []struct {
+		name  string
+		next  noise.DHKey
+		added bool
+		keys  []noise.DHKey
+	}{
+		{"first next key", first, true, []noise.DHKey{current, first, previous}},
+		{"same key again", first, false, []noise.DHKey{current, first, previous}},
+		{"replaced by another", second, true, []noise.DHKey{current, second, previous}},
+		{"current key", current, false, []noise.DHKey{current, second, previous}},
+	}
+	for _, step := range steps {
+		if added := srv.addNextKey(step.next); added != step.added {
+			t.Fatalf("%s: addNextKey = %v, want %v", step.name, added, step.added)
+		}
+		set := srv.keys.Load()
+		got, want := publicKeys(set.keys), publicKeys(step.keys)
+		if len(got) != len(want) {
+			t.Fatalf("%s: keys %v, want %v", step.name, got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("%s: keys %v, want %v", step.name, got, want)
+			}
+		}
+		if !bytes.Equal(set.next, step.keys[1].Public) {
+			t.Fatalf("%s: next key %s, want %s", step.name, fingerprint(set.next), want[1])
+		}
+	}
+}
+
+func TestAnnounceKeys(t *testing.T) {
+	current, next := generateTestKey(t), generateTestKey(t)
+	srv := &Server{}
+	srv.keys.Store(&serverKeySet{keys: []noise.DHKey{current}})
+
+	serverConn, clientConn := newPipe()
+	send, recv := newTestStates()
+	session := newSession(serverConn, send, nil, newPeerMonitor(time.Minute, 0))
+	announced := func() ServerKeys {
+		t.Helper()
+		err := srv.announceKeys(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := clientConn.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := decryptPacket(recv, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kind, payload, err := decodeMessage(message)
+		if err != nil || kind != messageControl {
+			t.Fatalf("got message %d, %v, want a control message", kind, err)
+		}
+		control, err := decodeControl(payload)
+		if err != nil || control.Kind != controlServerKeys {
+			t.Fatalf("got control message %v, %v, want %s", control, err, controlServerKeys)
+		}
+		var keys ServerKeys
+		err = json.Unmarshal(control.Body, &keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	want := ServerKeys{Current: hex.EncodeToString(current.Public)}
+	if got := announced(); got != want {
+		t.Errorf("before a next key: announced %+v, want %+v", got, want)
+	}
+	srv.addNextKey(next)
+	want.Next = hex.EncodeToString(next.Public)
+	if got := announced(); got != want {
+		t.Errorf("after a next key: announced %+v, want %+v", got, want)
+	}
+}
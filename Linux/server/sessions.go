@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// Linux/server/sessions.go
+// Per-peer session tracking for Linux server build
+// Developer: CyberPanther232
+
+// Session holds the state of a single connected client: its connection, the
+// cipher states produced by its own handshake and the address leased to it.
+type Session struct {
+	ID       uint64
+	Name     string
+	PeerKey  []byte
+	Groups   []string
+	Address  netip.Addr
+	Features []string // negotiated in the handshake
+	conn     Transport
+	send     *sendState
+	recv     *recvState
+	monitor  *peerMonitor
+
+	sendMu    sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newSession(conn Transport, send *sendState, recv *recvState, monitor *peerMonitor) *Session {
+	return &Session{
+		conn:    conn,
+		send:    send,
+		recv:    recv,
+		monitor: monitor,
+		done:    make(chan struct{}),
+	}
+}
+
+// Send encrypts an IP packet and writes it to the peer. It is safe to call
+// from multiple goroutines.
+func (s *Session) Send(packet []byte) error {
+	return s.SendMessage(messageData, packet)
+}
+
+func (s *Session) SendMessage(t messageType, payload []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	encryptedPacket := encryptPacket(s.send, encodeMessage(t, payload))
+	s.monitor.Sent()
+	return s.conn.Send(encryptedPacket)
+}
+
+func (s *Session) SendControl(kind string, body any) error {
+	payload, err := encodeControl(kind, body)
+	if err != nil {
+		return err
+	}
+	return s.SendMessage(messageControl, payload)
+}
+
+// Disconnect tells the peer why the session is ending before closing it.
+func (s *Session) Disconnect(reason string) {
+	s.SendMessage(messageClose, []byte(reason))
+	s.Close()
+}
+
+func (s *Session) RemoteAddr() string {
+	return s.conn.RemoteAddr().String()
+}
+
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// SessionRegistry tracks every live session on the server.
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[uint64]*Session
+	nextID   uint64
+}
+
+func newSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[uint64]*Session),
+	}
+}
+
+func (r *SessionRegistry) Add(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	s.ID = r.nextID
+	r.sessions[s.ID] = s
+}
+
+func (r *SessionRegistry) Remove(s *Session) {
+	r.mu.Lock()
+	delete(r.sessions, s.ID)
+	r.mu.Unlock()
+
+	s.Close()
+}
+
+func (r *SessionRegistry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+// Snapshot returns the sessions registered at the time of the call so callers
+// can iterate without holding the registry lock.
+func (r *SessionRegistry) Snapshot() []*Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (r *SessionRegistry) CloseAll() {
+	for _, s := range r.Snapshot() {
+		r.Remove(s)
+	}
+}
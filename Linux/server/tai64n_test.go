@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Linux/server/tai64n_test.go
+// TAI64N handshake timestamp tests for Linux server build
+// Developer: CyberPanther232
+
+var testTime = time.Date(2026, 3, 14, 15, 9, 26, 535897932, time.UTC)
+
+func TestTai64nOrdering(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  time.Time
+		after bool
+	}{
+		{"later second", testTime.Add(time.Second), testTime, true},
+		{"earlier second", testTime.Add(-time.Second), testTime, false},
+		{"same instant", testTime, testTime, false},
+		{"later beyond whitening", testTime.Add(20 * time.Millisecond), testTime, true},
+		{"later within whitening", testTime.Truncate(time.Second).Add(time.Millisecond), testTime.Truncate(time.Second), false},
+		{"years apart", testTime.AddDate(10, 0, 0), testTime, true},
+		{"before the Unix epoch", time.Unix(-1, 0), time.Unix(0, 0), false},
+		{"nanoseconds carry into seconds", time.Unix(101, 0), time.Unix(100, 999999999), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tai64nFromTime(tt.a).After(tai64nFromTime(tt.b)); got != tt.after {
+				t.Errorf("After = %v, want %v", got, tt.after)
+			}
+		})
+	}
+}
+
+func TestTai64nNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous time.Time
+		now      time.Time
+	}{
+		{"clock moved on", testTime, testTime.Add(time.Second)},
+		{"clock stood still", testTime, testTime},
+		{"clock within whitening", testTime.Truncate(time.Second), testTime.Truncate(time.Second).Add(time.Millisecond)},
+		{"clock went back", testTime, testTime.Add(-time.Hour)},
+		{"step crosses a second", time.Unix(100, 999000000), time.Unix(100, 999000000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := tai64nFromTime(tt.previous)
+			next := previous.next(tt.now)
+			if !next.After(previous) {
+				t.Fatalf("next(%s) = %x is not after %x", tt.now, next, previous)
+			}
+			if again := next.next(tt.now); !again.After(next) {
+				t.Errorf("a second next(%s) = %x is not after %x", tt.now, again, next)
+			}
+		})
+	}
+}
+
+func TestHandshakeTimestampsCheck(t *testing.T) {
+	clientKey := []byte("client key")
+	first := tai64nFromTime(testTime)
+	later := tai64nFromTime(testTime.Add(time.Second))
+
+	path := filepath.Join(t.TempDir(), "timestamps.yml")
+	timestamps, err := loadHandshakeTimestamps(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name      string
+		timestamp []byte
+		ok        bool
+		replay    bool
+	}{
+		{"legacy client without a timestamp", nil, true, false},
+		{"first timestamp", first[:], true, false},
+		{"replayed timestamp", first[:], false, true},
+		{"timestamp dropped after use", nil, false, false},
+		{"wrong length", first[:8], false, false},
+		{"newer timestamp", later[:], true, false},
+		{"older timestamp", first[:], false, true},
+	}
+	for _, step := range steps {
+		err := timestamps.Check(clientKey, step.timestamp)
+		if (err == nil) != step.ok {
+			t.Fatalf("%s: got error %v, want accepted = %v", step.name, err, step.ok)
+		}
+		if errors.Is(err, errReplayedHandshake) != step.replay {
+			t.Fatalf("%s: got error %v, want replay = %v", step.name, err, step.replay)
+		}
+	}
+
+	// The newest timestamp survives a restart
+	reloaded, err := loadHandshakeTimestamps(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Check(clientKey, later[:]); !errors.Is(err, errReplayedHandshake) {
+		t.Errorf("after reload, replay got %v, want %v", err, errReplayedHandshake)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Linux/server/timestamps.go
+// Handshake replay protection for Linux server build
+// Developer: CyberPanther232
+
+var errReplayedHandshake = errors.New("handshake timestamp is not newer than the last one")
+
+// HandshakeTimestamp is the latest handshake seen from a client, persisted so
+// a replay is still refused after a restart.
+type HandshakeTimestamp struct {
+	ClientKey string `yaml:"ClientKey"`
+	Timestamp string `yaml:"Timestamp"` // hex TAI64N
+}
+
+type HandshakeTimestamps struct {
+	mu     sync.Mutex
+	path   string
+	latest map[string]tai64n // keyed by hex client key
+}
+
+func loadHandshakeTimestamps(path string) (*HandshakeTimestamps, error) {
+	t := &HandshakeTimestamps{path: path, latest: make(map[string]tai64n)}
+	if path == "" || !fileExists(path) {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*HandshakeTimestamp
+	err = yaml.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timestamp file: %w", err)
+	}
+	for _, entry := range entries {
+		raw, err := hex.DecodeString(entry.Timestamp)
+		if err != nil || len(raw) != tai64nLen {
+			return nil, fmt.Errorf("invalid timestamp for client %s", entry.ClientKey)
+		}
+		t.latest[entry.ClientKey] = tai64n(raw)
+	}
+	return t, nil
+}
+
+// Check accepts a handshake timestamp from a client only if it is newer than
+// every one before it, and records it. Clients that have never sent a
+// timestamp predate replay protection and are let through without one.
+func (t *HandshakeTimestamps) Check(clientKey []byte, timestamp []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := hex.EncodeToString(clientKey)
+	latest, seen := t.latest[key]
+	if timestamp == nil {
+		if seen {
+			return errors.New("handshake has no timestamp")
+		}
+		return nil
+	}
+	if len(timestamp) != tai64nLen {
+		return fmt.Errorf("handshake timestamp must be %d bytes", tai64nLen)
+	}
+	ts := tai64n(timestamp)
+	if seen && !ts.After(latest) {
+		return errReplayedHandshake
+	}
+	t.latest[key] = ts
+	return t.save()
+}
+
+// save writes every timestamp to disk. The caller must hold t.mu.
+func (t *HandshakeTimestamps) save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	entries := make([]*HandshakeTimestamp, 0, len(t.latest))
+	for key, ts := range t.latest {
+		entries = append(entries, &HandshakeTimestamp{ClientKey: key, Timestamp: hex.EncodeToString(ts[:])})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ClientKey < entries[j].ClientKey
+	})
+
+	data, err := yaml.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := t.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
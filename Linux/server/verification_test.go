@@ -0,0 +1,57 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+// Linux/server/verification_test.go
+// Session verification code tests for Linux server build
+// Developer: CyberPanther232
+
+func TestVerificationWordsAreDistinct(t *testing.T) {
+	seen := make(map[string]int)
+	for i, word := range verificationWords {
+		if word == "" {
+			t.Errorf("word %d is empty", i)
+		}
+		if j, ok := seen[word]; ok {
+			t.Errorf("words %d and %d are both %q", j, i, word)
+		}
+		seen[word] = i
+	}
+}
+
+func TestVerificationCode(t *testing.T) {
+	format := regexp.MustCompile(`^[a-z]+ [a-z]+ [a-z]+ [a-z]+ \([0-9]{5} [0-9]{5}\)$`)
+	code := verificationCode([]byte("handshake hash"))
+	if !format.MatchString(code) {
+		t.Errorf("code %q is not four words and ten digits", code)
+	}
+	if again := verificationCode([]byte("handshake hash")); again != code {
+		t.Errorf("the same hash gave %q and %q", code, again)
+	}
+	if other := verificationCode([]byte("handshake hasH")); other == code {
+		t.Errorf("different hashes both gave %q", code)
+	}
+}
+
+// Both ends of a handshake show the same code, and a client that ran its
+// handshake with someone else sees another one.
+func TestVerificationCodeMatchesAcrossHandshake(t *testing.T) {
+	serverKey := generateTestKey(t)
+	client := testClient{Mode: testMode("XX"), Key: generateTestKey(t), Transport: "tcp"}
+	first := runHandshake(client, []noise.DHKey{serverKey}, testServerOptions())
+	checkRoundTrip(t, client, serverKey, first)
+	if got, want := verificationCode(first.client.channelBinding), verificationCode(first.binding); got != want {
+		t.Errorf("client shows %q, server shows %q", got, want)
+	}
+
+	second := runHandshake(client, []noise.DHKey{serverKey}, testServerOptions())
+	checkRoundTrip(t, client, serverKey, second)
+	if verificationCode(second.binding) == verificationCode(first.binding) {
+		t.Error("two sessions got the same code")
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+	"golang.org/x/term"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Windows/client/client.go
+// Connection supervision for Windows client build
+// Developer: CyberPanther232
+
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// Client owns the TUN device for the lifetime of the process and keeps a
+// tunnel to the server attached to it, reconnecting whenever the tunnel is
+// lost. Applications keep their sockets because the device never goes away.
+type Client struct {
+	config       *ClientConfig
+	dev          tun.Device
+	clientKey    noise.DHKey
+	verifyServer func(peerStatic []byte) error
+	pattern      *handshakePattern
+	suite        *cipherSuite
+
+	tunnel  atomic.Pointer[Tunnel]
+	address netip.Prefix
+	mtu     int
+	closing atomic.Bool
+
+	// Server key whose verification code the user has confirmed
+	confirmedKey []byte
+
+	// Timestamp of the last handshake, which the next one must exceed
+	lastTimestamp tai64n
+
+	// Handlers for control messages from the server, keyed by kind
+	control map[string]controlHandler
+}
+
+type controlHandler func(tunnel *Tunnel, body json.RawMessage) error
+
+func newClient(config *ClientConfig, dev tun.Device, clientKey noise.DHKey, verifyServer func(peerStatic []byte) error) (*Client, error) {
+	pattern, err := lookupHandshakePattern(config.HandshakePattern)
+	if err != nil {
+		return nil, err
+	}
+	suite, err := lookupCipherSuite(config.CipherSuite)
+	if err != nil {
+		return nil, err
+	}
+	if pattern.UsesPSK() != (config.PresharedKeyFile != "") {
+		return nil, fmt.Errorf("handshake pattern %s and PresharedKeyFile must be used together", pattern.Name)
+	}
+	if config.PresharedKeyFile != "" {
+		_, err = loadPresharedKeys(config.PresharedKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load pre-shared keys: %w", err)
+		}
+	}
+
+	if config.CertificateFile != "" {
+		_, cert, err := loadCertificate(config.CertificateFile, clientKey.Public)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+		log.Printf("Presenting certificate for %q valid until %s\n", cert.Name, cert.NotAfter.Format(time.RFC3339))
+		if time.Now().After(cert.NotAfter) {
+			log.Println("Certificate has expired; servers that do not list this key will refuse it")
+		}
+	}
+
+	if config.ConfirmVerificationCode && !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("ConfirmVerificationCode needs the client to run in a terminal")
+	}
+
+	c := &Client{
+		config:       config,
+		dev:          dev,
+		clientKey:    clientKey,
+		verifyServer: verifyServer,
+		pattern:      pattern,
+		suite:        suite,
+		mtu:          config.MTU,
+		control:      make(map[string]controlHandler),
+	}
+	c.control[controlServerKeys] = c.updateServerKeys
+	return c, nil
+}
+
+// Run connects to the server and reconnects with exponential backoff every
+// time the tunnel is lost, until Close is called.
+func (c *Client) Run() {
+	go c.upstream()
+
+	attempt := 0
+	for {
+		tunnel, err := c.connect()
+		if err != nil {
+			delay := reconnectDelay(attempt)
+			attempt++
+			log.Printf("Connection failed: %v (retrying in %s)", err, delay.Round(time.Millisecond))
+			time.Sleep(delay)
+			continue
+		}
+		attempt = 0
+
+		c.tunnel.Store(tunnel)
+		go c.downstream(tunnel)
+		go tunnel.monitor.Run(tunnel.Done(), func() error {
+			return tunnel.SendMessage(messageKeepalive, nil)
+		}, func() {
+			log.Printf("No traffic from server for %s, closing tunnel\n", tunnel.monitor.timeout)
+			tunnel.Close()
+		})
+
+		<-tunnel.Done()
+		c.tunnel.CompareAndSwap(tunnel, nil)
+		if c.closing.Load() {
+			return
+		}
+		log.Println("Tunnel to server lost, reconnecting...")
+	}
+}
+
+// Close tears down the current tunnel, if any, letting the server know.
+func (c *Client) Close() {
+	c.closing.Store(true)
+	if tunnel := c.tunnel.Load(); tunnel != nil {
+		tunnel.Disconnect("client shutting down")
+	}
+}
+
+// connect dials the server, runs the handshake and points the TUN device at
+// the address the server leased to us.
+func (c *Client) connect() (*Tunnel, error) {
+	conn, err := dialTransport(c.config.Transport, c.config.ServerAddress+":"+fmt.Sprint(c.config.ServerPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	log.Printf("Connected to server over %s\n", c.config.Transport)
+
+	hello := &ClientHello{
+		Version:    protocolVersion,
+		Name:       c.config.Name,
+		Transports: transportNames(),
+		Ciphers:    cipherSuiteNames(),
+		MTU:        c.config.MTU,
+		Features:   supportedFeatures,
+	}
+	c.lastTimestamp = c.lastTimestamp.next(time.Now())
+	hello.Timestamp = c.lastTimestamp[:]
+	// Read on every attempt so a renewed certificate takes effect on
+	// reconnect
+	if c.config.CertificateFile != "" {
+		hello.Certificate, _, err = loadCertificate(c.config.CertificateFile, c.clientKey.Public)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+	}
+	helloPayload, err := encodeClientHello(hello)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	opts, err := c.handshakeOptions()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tunnel, replyPayload, err := runClientHandshake(conn, c.clientKey, opts, helloPayload, c.verifyServer)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+
+	reply, err := decodeServerReply(replyPayload)
+	if err != nil {
+		tunnel.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	address, err := reply.InterfacePrefix()
+	if err != nil {
+		tunnel.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	// Servers that predate negotiation send no version
+	version := max(reply.Version, minProtocolVersion)
+	if version > protocolVersion {
+		tunnel.Close()
+		return nil, fmt.Errorf("handshake failed: server chose unsupported protocol version %d", version)
+	}
+	log.Printf("Assigned address %s (gateway %s), protocol %d, features %v\n", address, reply.Gateway, version, reply.Features)
+
+	tunnel.send.policy = newRekeyPolicy(c.config.RekeyInterval, c.config.RekeyBytes)
+	// Servers that never send keepalives cannot be told apart from dead ones
+	timeout := c.config.PeerTimeout
+	if !slices.Contains(reply.Features, featureKeepalive) {
+		timeout = 0
+	}
+	tunnel.monitor = newPeerMonitor(c.config.KeepaliveInterval, timeout)
+
+	code := verificationCode(tunnel.channelBinding)
+	log.Printf("Verification code %s\n", code)
+	if c.config.ConfirmVerificationCode && !bytes.Equal(tunnel.serverKey, c.confirmedKey) {
+		err = confirmVerificationCode(code)
+		if err != nil {
+			tunnel.Disconnect("verification code not confirmed")
+			return nil, err
+		}
+		c.confirmedKey = tunnel.serverKey
+	}
+
+	if reply.MTU > 0 && reply.MTU != c.mtu {
+		log.Printf("Setting interface MTU to %d\n", reply.MTU)
+		setInterfaceMTU("BurrowClient", reply.MTU)
+		c.mtu = reply.MTU
+	}
+
+	// Leases are sticky, so after a reconnect the interface usually keeps
+	// its address and nothing needs to change
+	if address != c.address {
+		configureInterface("BurrowClient", address)
+		c.address = address
+	}
+	return tunnel, nil
+}
+
+// confirmVerificationCode asks the user to compare the verification code
+// with the one the server logged for the session. Once the server's key has
+// been confirmed, later sessions with the same key are trusted without
+// asking again, as nobody can sit in the middle of those without that key.
+func confirmVerificationCode(code string) error {
+	fmt.Fprintf(os.Stderr, "Verification code: %s\nDoes the server show the same code? [y/N] ", code)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read answer: %w", err)
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return errors.New("verification code not confirmed, the session may be intercepted")
+	}
+	return nil
+}
+
+// handshakeOptions picks the configured pattern, falling back to its
+// bootstrap pattern while the server's key is not known yet. Pre-shared keys
+// are read on every attempt so a rotated key file takes effect on reconnect.
+func (c *Client) handshakeOptions() (handshakeOptions, error) {
+	opts := handshakeOptions{Pattern: c.pattern, CipherSuite: c.suite, Hybrid: c.config.PostQuantum, Transport: c.config.Transport}
+	if c.config.PresharedKeyFile != "" {
+		keys, err := loadPresharedKeys(c.config.PresharedKeyFile)
+		if err != nil {
+			return opts, fmt.Errorf("failed to load pre-shared keys: %w", err)
+		}
+		opts.PresharedKeys = keys
+	}
+
+	serverKeys, err := knownServerKeys(c.config)
+	if err != nil {
+		return opts, err
+	}
+	if serverKeys == nil && c.pattern.KnowsResponder() {
+		bootstrap, err := lookupHandshakePattern(c.pattern.Bootstrap)
+		if err != nil {
+			return opts, err
+		}
+		log.Printf("Server key not known yet, using %s instead of %s\n", bootstrap.Name, c.pattern.Name)
+		opts.Pattern = bootstrap
+		return opts, nil
+	}
+	if serverKeys != nil {
+		opts.ServerKey = serverKeys[0]
+	}
+	return opts, nil
+}
+
+// upstream reads packets from the TUN device and sends them through whatever
+// tunnel is current. Packets captured while reconnecting are dropped.
+func (c *Client) upstream() {
+	batch := c.dev.BatchSize()
+	packets := make([][]byte, batch)
+	for i := range packets {
+		packets[i] = make([]byte, tunBufferSize)
+	}
+	sizes := make([]int, batch)
+	for {
+		n, err := c.dev.Read(packets, sizes, tunOffset)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		// A failed read, such as an offload packet with more segments than
+		// the batch holds, only loses those packets
+		if err != nil {
+			log.Printf("Upstream: Error reading from TUN device: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			packetData := packets[i][tunOffset : tunOffset+sizes[i]]
+			if len(packetData) == 0 {
+				continue
+			}
+			log.Printf("Upstream: Raw packet: %d bytes\n", len(packetData))
+
+			tunnel := c.tunnel.Load()
+			if tunnel == nil {
+				log.Printf("Upstream: Not connected, dropping packet")
+				continue
+			}
+			err = tunnel.Send(packetData)
+			if err != nil {
+				log.Printf("Upstream: Failed to send to server: %v", err)
+			}
+		}
+	}
+}
+
+// downstream writes packets from the server into the TUN device until the
+// tunnel fails, then closes it so Run can reconnect.
+func (c *Client) downstream(tunnel *Tunnel) {
+	for {
+		ciphertext, err := tunnel.conn.Receive()
+		if err != nil {
+			log.Printf("Downstream: Error reading from server: %v", err)
+			tunnel.Close()
+			return
+		}
+		log.Printf("Downstream: Received %d bytes\n", len(ciphertext))
+
+		// Forged, corrupted or replayed packets are dropped, not fatal
+		decryptedPacket, err := decryptPacket(tunnel.recv, ciphertext)
+		if err != nil {
+			log.Printf("Downstream: Dropping packet: %v", err)
+			continue
+		}
+		tunnel.monitor.Received()
+
+		msgType, payload, err := decodeMessage(decryptedPacket)
+		if err != nil {
+			log.Printf("Downstream: Dropping packet: %v", err)
+			continue
+		}
+
+		switch msgType {
+		case messageData:
+			log.Printf("Downstream: Decrypted packet: %d bytes\n", len(payload))
+
+			// Write the data received from the server back into our local OS
+			err = writeTUN(c.dev, payload)
+			if err != nil {
+				log.Printf("Downstream: Error writing to TUN device: %v", err)
+			}
+		case messageKeepalive:
+			log.Printf("Downstream: Keepalive from server\n")
+		case messageClose:
+			log.Printf("Tunnel closed by server: %s\n", payload)
+			tunnel.Close()
+			return
+		case messageControl:
+			c.handleControl(tunnel, payload)
+		default:
+			log.Printf("Downstream: Dropping unknown %s message", msgType)
+		}
+	}
+}
+
+// handleControl routes a control message to the handler registered for its
+// kind. Control messages never reach the TUN device.
+func (c *Client) handleControl(tunnel *Tunnel, payload []byte) {
+	control, err := decodeControl(payload)
+	if err != nil {
+		log.Printf("Downstream: Dropping control message: %v", err)
+		return
+	}
+	handler, ok := c.control[control.Kind]
+	if !ok {
+		log.Printf("Downstream: Ignoring unknown control message %q", control.Kind)
+		return
+	}
+	err = handler(tunnel, control.Body)
+	if err != nil {
+		log.Printf("Downstream: Control message %q failed: %v", control.Kind, err)
+	}
+}
+
+// reconnectDelay doubles the wait after every failed attempt up to
+// reconnectMaxDelay, and picks a random point in the upper half of it so that
+// clients cut off together do not all come back at the same moment.
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = min(reconnectMinDelay<<attempt, reconnectMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
+	"strings"
+	"time"
 
 	"github.com/flynn/noise"
 )
@@ -14,98 +19,351 @@ import (
 // Cryptography functions for Windows client build
 // Developer: CyberPanther232
 
-var suite = noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+const (
+	packetHeaderLen  = 12 // 4-byte key epoch + 8-byte counter
+	handshakeTimeout = 10 * time.Second
+)
+
+var errReplayedPacket = errors.New("replayed or out-of-window packet")
 
 func generateIdentity() (noise.DHKey, error) {
-	return suite.GenerateKeypair(nil)
+	return noise.DH25519.GenerateKeypair(nil)
 }
 
-func sendFramed(conn net.Conn, data []byte) error {
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
-	_, err := conn.Write(lenBuf)
-	if err != nil {
-		return err
+// parsePublicKey accepts a 32-byte Curve25519 public key in hex or base64.
+func parsePublicKey(s string) ([]byte, error) {
+	key, ok := decodeKey(s)
+	if !ok {
+		return nil, errors.New("public key must be 32 bytes encoded as hex or base64")
 	}
-	_, err = conn.Write(data)
-	return err
+	return key, nil
 }
 
-func readFramed(conn net.Conn) ([]byte, error) {
-	lenBuf := make([]byte, 4)
-	_, err := io.ReadFull(conn, lenBuf)
-	if err != nil {
-		return nil, err
+// decodeKey decodes a 32-byte key written as hex or any common base64 form.
+func decodeKey(s string) ([]byte, bool) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, true
 	}
-	length := binary.BigEndian.Uint32(lenBuf)
-	data := make([]byte, length)
-	_, err = io.ReadFull(conn, data)
-	if err != nil {
-		return nil, err
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(s); err == nil && len(key) == 32 {
+			return key, true
+		}
 	}
-	return data, nil
+	return nil, false
 }
 
-func runClientHandshake(conn net.Conn, clientKey noise.DHKey) (*noise.CipherState, *noise.CipherState, error) {
-	hs, err := noise.NewHandshakeState(noise.Config{
-		CipherSuite:   suite,
-		Random:        nil,
-		Pattern:       noise.HandshakeXX,
-		Initiator:     true,
-		StaticKeypair: clientKey,
-	})
+// fingerprint is a short, printable identifier for a public key.
+func fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// handshakeOptions selects the pattern a client runs and the keys the
+// pattern needs before the first message.
+type handshakeOptions struct {
+	Pattern       *handshakePattern
+	CipherSuite   *cipherSuite
+	PresharedKeys [][]byte // newest first
+	ServerKey     []byte   // pinned server key, if known; IK encrypts to it and XX names it in a hint
+	Hybrid        bool     // add ML-KEM-768 to the handshake
+	Transport     string   // hashed into the prologue
+}
+
+// runClientHandshake performs the initiator side of the handshake and returns
+// the established tunnel together with the server's reply payload. The
+// server's static key is passed to verifyServer as soon as it is received,
+// and hello is only sent encrypted to an authenticated server key. A hybrid
+// handshake mixes an ML-KEM-768 shared secret into the session keys, and the
+// reply then always follows under those keys.
+func runClientHandshake(conn Transport, clientKey noise.DHKey, opts handshakeOptions, hello []byte, verifyServer func(peerStatic []byte) error) (*Tunnel, []byte, error) {
+	pattern := opts.Pattern
+	mode := handshakeMode{Pattern: pattern, Suite: opts.CipherSuite, Hybrid: opts.Hybrid}
+	config := mode.noiseConfig(true, clientKey, opts.Transport)
+	if pattern.KnowsResponder() {
+		config.PeerStatic = opts.ServerKey
+	}
+	transcript, err := newHandshakeTranscript(config)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create handshake state: %w", err)
 	}
-
-	// 1. Write the first message (e)
-	msg, _, _, err := hs.WriteMessage(nil, nil)
+	hs, err := transcript.start(nil)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to write handshake message 1: %w", err)
+		return nil, nil, fmt.Errorf("failed to create handshake state: %w", err)
 	}
-	log.Printf("Sending handshake message 1 to server: %d bytes\n", len(msg))
-	err = sendFramed(conn, msg)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to send handshake message 1: %w", err)
+
+	var decapsulationKey *mlkem.DecapsulationKey768
+	var kemSecret []byte
+	if opts.Hybrid {
+		decapsulationKey, err = mlkem.GenerateKey768()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate ML-KEM key: %w", err)
+		}
 	}
+	id := mode.ID()
 
-	// 2. Read the second message (e, ee, s, es)
-	msg, err = readFramed(conn)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read handshake message 2: %w", err)
+	// Datagrams can be lost, so never wait on a handshake message forever
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// 1. Run the pattern. Even messages are ours and the last of them
+	// carries the hello; the server's reply rides in its final message if
+	// the pattern ends with one
+	messages := len(pattern.Pattern.Messages)
+	lastFromClient := (messages - 1) &^ 1
+	pskMessage := pattern.PSKPlacement - 1
+	replyInHandshake := lastFromClient != messages-1 && !opts.Hybrid
+	verified := false
+	var first []byte
+	var reply []byte
+	var sendCipher, recvCipher *noise.CipherState
+	for i := 0; i < messages; i++ {
+		if i%2 == 0 {
+			var payload []byte
+			if i == 0 && opts.Hybrid {
+				payload = append(payload, decapsulationKey.EncapsulationKey().Bytes()...)
+			}
+			// A server in the middle of a key rotation presents the key
+			// we have pinned
+			if i == 0 && !pattern.KnowsResponder() && opts.ServerKey != nil {
+				payload = append(payload, keyHint(opts.ServerKey)...)
+			}
+			if i == lastFromClient {
+				payload = append(payload, hello...)
+			}
+			if i == pskMessage {
+				if len(opts.PresharedKeys) == 0 {
+					return nil, nil, errors.New("no pre-shared key configured")
+				}
+				hs.SetPresharedKey(opts.PresharedKeys[0])
+			}
+			// The server sends with the first cipher state and reads with the second
+			msg, cs1, cs2, err := hs.WriteMessage(nil, payload)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to write handshake message %d: %w", i+1, err)
+			}
+			transcript.wrote(payload)
+			recvCipher, sendCipher = cs1, cs2
+			log.Printf("Sending handshake message %d to server: %d bytes (%s)\n", i+1, len(msg), mode.String())
+			err = sendHandshake(conn, id, msg)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to send handshake message %d: %w", i+1, err)
+			}
+			if i == 0 {
+				first = msg
+			}
+		} else {
+			msg, err := receiveHandshake(conn, id)
+			// A server under load keeps nothing for a new UDP address
+			// until it has seen its cookie, so the first message is simply
+			// sent again with it
+			var challenge *cookieChallenge
+			if i == 1 && errors.As(err, &challenge) {
+				log.Println("Server is under load, sending handshake message 1 again with its cookie")
+				frame := append([]byte{handshakeCookie}, challenge.Cookie...)
+				frame = append(append(frame, id), first...)
+				err = conn.Send(frame)
+				if err == nil {
+					msg, err = receiveHandshake(conn, id)
+				}
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read handshake message %d: %w", i+1, err)
+			}
+			log.Printf("Received handshake message %d from server: %d bytes\n", i+1, len(msg))
+			var payload []byte
+			var cs1, cs2 *noise.CipherState
+			if i == pskMessage {
+				hs, payload, cs1, cs2, _, err = transcript.readWithPSK(msg, opts.PresharedKeys)
+			} else {
+				payload, cs1, cs2, err = hs.ReadMessage(nil, msg)
+				if err != nil {
+					err = readHandshakeError(err)
+				}
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to process handshake message %d: %w", i+1, err)
+			}
+			transcript.read(msg)
+			recvCipher, sendCipher = cs1, cs2
+			if !verified {
+				err = verifyServer(hs.PeerStatic())
+				if err != nil {
+					return nil, nil, fmt.Errorf("server authentication failed: %w", err)
+				}
+				verified = true
+			}
+			if i == 1 && opts.Hybrid {
+				var ciphertext []byte
+				ciphertext, payload, err = splitKEM(payload, mlkem.CiphertextSize768)
+				if err == nil {
+					kemSecret, err = decapsulationKey.Decapsulate(ciphertext)
+				}
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to process handshake message %d: %w", i+1, err)
+				}
+			}
+			if i == messages-1 && replyInHandshake {
+				reply = payload
+			}
+		}
 	}
-	log.Printf("Received handshake message 2 from server: %d bytes\n", len(msg))
-	_, _, _, err = hs.ReadMessage(nil, msg)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to process handshake message 2: %w", err)
+	if opts.Hybrid {
+		sendCipher, err = mixKEMSecret(mode.Suite.Suite, sendCipher, kemSecret, hs.ChannelBinding())
+		if err == nil {
+			recvCipher, err = mixKEMSecret(mode.Suite.Suite, recvCipher, kemSecret, hs.ChannelBinding())
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to mix in ML-KEM secret: %w", err)
+		}
 	}
+	tunnel := newTunnel(conn, newSendState(sendCipher), newRecvState(mode.Suite.Suite, recvCipher))
+	tunnel.serverKey = hs.PeerStatic()
+	tunnel.channelBinding = hs.ChannelBinding()
 
-	// 3. Write the third message (s, se)
-	msg, sendCipher, recvCipher, err := hs.WriteMessage(nil, nil)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to write handshake message 3: %w", err)
+	// 2. Unless it rode in the server's last handshake message, the reply
+	// follows under the session keys
+	if !replyInHandshake {
+		msg, err := conn.Receive()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read handshake reply: %w", err)
+		}
+		log.Printf("Received handshake reply from server: %d bytes\n", len(msg))
+		reply, err = decryptPacket(tunnel.recv, msg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt handshake reply: %w", err)
+		}
 	}
-	log.Printf("Sending handshake message 3 to server: %d bytes\n", len(msg))
-	err = sendFramed(conn, msg)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to send handshake message 3: %w", err)
+
+	return tunnel, reply, nil
+}
+
+const (
+	defaultRekeyInterval = 2 * time.Minute
+	defaultRekeyBytes    = 1 << 30
+)
+
+// rekeyPolicy decides when a sender moves its direction of the session to the
+// next key. Zero values disable the corresponding trigger.
+type rekeyPolicy struct {
+	Interval time.Duration
+	Bytes    uint64
+}
+
+// newRekeyPolicy builds a policy from configuration values, where anything
+// not positive turns the trigger off.
+func newRekeyPolicy(interval time.Duration, bytes int64) rekeyPolicy {
+	var policy rekeyPolicy
+	if interval > 0 {
+		policy.Interval = interval
 	}
+	if bytes > 0 {
+		policy.Bytes = uint64(bytes)
+	}
+	return policy
+}
+
+// sendState is the sending half of a session. Every packet is prefixed with a
+// header of the key epoch and the 64-bit counter used as the AEAD nonce, so
+// the receiver can decrypt packets independently of their arrival order.
+type sendState struct {
+	cs        *noise.CipherState
+	epoch     uint32
+	bytes     uint64
+	rekeyedAt time.Time
+	policy    rekeyPolicy
+}
+
+func newSendState(cs *noise.CipherState) *sendState {
+	return &sendState{cs: cs, rekeyedAt: time.Now()}
+}
+
+// recvState is the receiving half of a session. It follows the sender to the
+// next epoch the first time a packet authenticates under the next key, and
+// keeps the previous key around for packets still in flight.
+type recvState struct {
+	suite  noise.CipherSuite
+	cs     *noise.CipherState
+	prev   *noise.CipherState
+	epoch  uint32
+	replay replayWindow
+}
+
+func newRecvState(suite noise.CipherSuite, cs *noise.CipherState) *recvState {
+	return &recvState{suite: suite, cs: cs}
+}
 
-	return sendCipher, recvCipher, nil
+func (s *sendState) needsRekey() bool {
+	if s.policy.Interval > 0 && time.Since(s.rekeyedAt) >= s.policy.Interval {
+		return true
+	}
+	return s.policy.Bytes > 0 && s.bytes >= s.policy.Bytes
 }
 
-func encryptPacket(cs *noise.CipherState, plaintext []byte) []byte {
-	encryptedPacket, err := cs.Encrypt(nil, nil, plaintext)
+// encryptPacket seals plaintext for the peer, rekeying first if the policy
+// says the current key has been used long enough. It is not safe for
+// concurrent use; callers serialize sends.
+func encryptPacket(s *sendState, plaintext []byte) []byte {
+	if s.needsRekey() {
+		s.cs.Rekey()
+		s.epoch++
+		s.bytes = 0
+		s.rekeyedAt = time.Now()
+		log.Printf("Rekeyed sending key to epoch %d\n", s.epoch)
+	}
+
+	encryptedPacket := make([]byte, packetHeaderLen, packetHeaderLen+len(plaintext)+16)
+	binary.BigEndian.PutUint32(encryptedPacket[0:4], s.epoch)
+	binary.BigEndian.PutUint64(encryptedPacket[4:12], s.cs.Nonce())
+
+	encryptedPacket, err := s.cs.Encrypt(encryptedPacket, encryptedPacket[:packetHeaderLen], plaintext)
 	if err != nil {
 		log.Fatalf("Failed to encrypt packet: %v", err)
 	}
+	s.bytes += uint64(len(plaintext))
 	return encryptedPacket
 }
 
-func decryptPacket(cs *noise.CipherState, ciphertext []byte) ([]byte, error) {
-	decryptedPacket, err := cs.Decrypt(nil, nil, ciphertext)
+func decryptPacket(r *recvState, packet []byte) ([]byte, error) {
+	if len(packet) < packetHeaderLen {
+		return nil, errors.New("packet too short")
+	}
+	header := packet[:packetHeaderLen]
+	epoch := binary.BigEndian.Uint32(header[0:4])
+	counter := binary.BigEndian.Uint64(header[4:12])
+	if counter > noise.MaxNonce || !r.replay.Check(counter) {
+		return nil, errReplayedPacket
+	}
+
+	var cs *noise.CipherState
+	advance := false
+	switch {
+	case epoch == r.epoch:
+		cs = r.cs
+	case epoch == r.epoch-1 && r.prev != nil:
+		cs = r.prev
+	case epoch == r.epoch+1:
+		// Derive the next key on a copy and only commit to it once a
+		// packet authenticates under it
+		cs = noise.UnsafeNewCipherState(r.suite, r.cs.UnsafeKey(), 0)
+		cs.Rekey()
+		advance = true
+	default:
+		return nil, fmt.Errorf("packet from unknown key epoch %d (current %d)", epoch, r.epoch)
+	}
+
+	cs.SetNonce(counter)
+	decryptedPacket, err := cs.Decrypt(nil, header, packet[packetHeaderLen:])
 	if err != nil {
 		return nil, err
 	}
+	r.replay.Accept(counter)
+
+	if advance {
+		r.prev = r.cs
+		r.cs = cs
+		r.epoch = epoch
+		log.Printf("Rekeyed receiving key to epoch %d\n", r.epoch)
+	}
 	return decryptedPacket, nil
 }
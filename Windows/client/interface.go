@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os/exec"
+	"strconv"
+)
+
+// Windows/client/interface.go
+// TUN interface helpers for Windows client build
+// Developer: CyberPanther232
+
+// Headroom the TUN driver expects in front of each packet handed to Write
+const tunOffset = 4
+
+// Room for the largest packet a read can return. With offloads enabled a
+// read may carry a segmentation offload packet of up to 64 KiB.
+const tunBufferSize = tunOffset + 65535
+
+func configureInterface(name string, address netip.Prefix) {
+	mask := net.IP(net.CIDRMask(address.Bits(), address.Addr().BitLen())).String()
+	cmd := exec.Command("netsh", "interface", "ip", "set", "address",
+		"name="+name, "static", address.Addr().String(), mask, "none")
+	cmd.Run()
+}
+
+func setInterfaceMTU(name string, mtu int) {
+	cmd := exec.Command("netsh", "interface", "ipv4", "set", "subinterface",
+		name, "mtu="+strconv.Itoa(mtu), "store=active")
+	cmd.Run()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/flynn/noise"
+)
+
+// Windows/client/kem.go
+// Hybrid ML-KEM key exchange for Windows client build
+// Developer: CyberPanther232
+
+// A hybrid handshake runs the usual Noise pattern and an ML-KEM-768
+// encapsulation next to it. The client's first payload starts with a fresh
+// encapsulation key and the server's first payload with the ciphertext, so
+// both are authenticated by the Noise transcript. The shared secret is mixed
+// into the session keys after the handshake, which stay safe as long as
+// either X25519 or ML-KEM holds.
+//
+// Hybrid handshake messages set hybridFlag in the pattern ID, so a server
+// that disagrees about using it refuses the pattern instead of failing
+// somewhere inside the payloads.
+const hybridFlag byte = 0x80
+
+const hybridSuffix = "+mlkem768"
+
+// splitKEM takes the fixed-size KEM field off the front of a payload.
+func splitKEM(payload []byte, size int) ([]byte, []byte, error) {
+	if len(payload) < size {
+		return nil, nil, fmt.Errorf("payload too short for ML-KEM data: %d bytes", len(payload))
+	}
+	return payload[:size], payload[size:], nil
+}
+
+// mixKEMSecret derives the hybrid key for one direction of the session from
+// its Noise key, the ML-KEM shared secret and the handshake hash.
+func mixKEMSecret(suite noise.CipherSuite, cs *noise.CipherState, secret, channelBinding []byte) (*noise.CipherState, error) {
+	key := cs.UnsafeKey()
+	mixed, err := hkdf.Key(sha256.New, secret, key[:], "burrow hybrid mlkem768 "+string(channelBinding), len(key))
+	if err != nil {
+		return nil, err
+	}
+	return noise.UnsafeNewCipherState(suite, [32]byte(mixed), 0), nil
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"errors"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
 )
 
 // Windows/client/load_config.go
@@ -14,9 +18,58 @@ import (
 type ClientConfig struct {
 	ServerAddress string `yaml:"ServerAddress"`
 	ServerPort    int    `yaml:"ServerPort"`
+	Transport     string `yaml:"Transport"`
 	ClientKeyFile string `yaml:"ClientKeyFile"`
+	// Protect a newly generated private key with a passphrase
+	EncryptPrivateKey bool `yaml:"EncryptPrivateKey"`
+
+	// Name reported to the server in the handshake, defaults to the hostname
+	Name string `yaml:"Name"`
+	// MTU of the tunnel interface; lowered if the server asks for less
+	MTU int `yaml:"MTU"`
+
+	// Noise pattern to connect with (XX, IK, XXpsk3, IKpsk2). IK needs the
+	// server key in advance and uses its XX variant until it is known. The
+	// psk variants mix in the key from PresharedKeyFile
+	HandshakePattern string `yaml:"HandshakePattern"`
+	PresharedKeyFile string `yaml:"PresharedKeyFile"`
+
+	// Add ML-KEM-768 to the handshake; the server must be configured the
+	// same way or the handshake is refused
+	PostQuantum bool `yaml:"PostQuantum"`
+
+	// Cipher suite to encrypt with; ChaChaPoly_BLAKE2s is faster on
+	// machines without AES acceleration. Must be accepted by the server
+	CipherSuite string `yaml:"CipherSuite"`
+
+	// Certificate from a CA the server trusts, for servers that do not list
+	// this client's key; made with the server's signcert command
+	CertificateFile string `yaml:"CertificateFile"`
+
+	// Expected server static public key, hex or base64
+	ServerPublicKey string `yaml:"ServerPublicKey"`
+	// Without a ServerPublicKey, pin whatever key the server presents on the
+	// first connection and record it in KnownServersFile
+	TrustOnFirstUse  bool   `yaml:"TrustOnFirstUse"`
+	KnownServersFile string `yaml:"KnownServersFile"`
+	// Ask on the terminal whether the server shows the same verification
+	// code before the interface is configured
+	ConfirmVerificationCode bool `yaml:"ConfirmVerificationCode"`
+
+	// Move the tunnel to a fresh key after this long or this many bytes,
+	// whichever comes first. A negative interval or byte count disables it
+	RekeyInterval time.Duration `yaml:"RekeyInterval"`
+	RekeyBytes    int64         `yaml:"RekeyBytes"`
+
+	// Send a keepalive after KeepaliveInterval without outgoing traffic and
+	// drop the tunnel after PeerTimeout without incoming traffic. A negative
+	// value disables either
+	KeepaliveInterval time.Duration `yaml:"KeepaliveInterval"`
+	PeerTimeout       time.Duration `yaml:"PeerTimeout"`
 }
 
+const defaultMTU = 1500
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
@@ -39,5 +92,62 @@ func loadClientConfig(path string) (*ClientConfig, error) {
 		return nil, err
 	}
 
+	if config.Transport == "" {
+		config.Transport = defaultTransport
+	}
+	if config.HandshakePattern == "" {
+		config.HandshakePattern = defaultHandshakePattern
+	}
+	if config.CipherSuite == "" {
+		config.CipherSuite = defaultCipherSuite
+	}
+	if config.Name == "" {
+		config.Name, _ = os.Hostname()
+	}
+	if config.MTU == 0 {
+		config.MTU = defaultMTU
+	}
+	if config.ClientKeyFile == "" {
+		config.ClientKeyFile = "client.key"
+	}
+	if config.KnownServersFile == "" {
+		config.KnownServersFile = "known_servers"
+	}
+	if config.RekeyInterval == 0 {
+		config.RekeyInterval = defaultRekeyInterval
+	}
+	if config.RekeyBytes == 0 {
+		config.RekeyBytes = defaultRekeyBytes
+	}
+	if config.KeepaliveInterval == 0 {
+		config.KeepaliveInterval = defaultKeepaliveInterval
+	}
+	if config.PeerTimeout == 0 {
+		config.PeerTimeout = defaultPeerTimeout
+	}
+
 	return config, nil
 }
+
+func saveKey(path string, key noise.DHKey, encrypt bool) error {
+	return writeKeyFile(path, key.Private, encrypt)
+}
+
+func loadKey(path string) (noise.DHKey, error) {
+	priv, err := readKeyFile(path)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	if len(priv) != 32 {
+		return noise.DHKey{}, errors.New("invalid private key length")
+	}
+
+	var pub, privKey [32]byte
+	copy(privKey[:], priv)
+	curve25519.ScalarBaseMult(&pub, &privKey)
+
+	return noise.DHKey{
+		Private: priv,
+		Public:  pub[:],
+	}, nil
+}
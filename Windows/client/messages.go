@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Windows/client/messages.go
+// Tunnel message envelope for Windows client build
+// Developer: CyberPanther232
+
+// Every encrypted packet after the handshake carries one message:
+//
+//	[version 1 byte][type 1 byte][payload]
+//
+// Only data messages reach the TUN device; everything else is handled by the
+// tunnel itself.
+const messageVersion = 1
+
+const messageHeaderLen = 2
+
+type messageType byte
+
+const (
+	messageData      messageType = 1 // payload is an IP packet
+	messageKeepalive messageType = 2 // no payload
+	messageClose     messageType = 3 // payload is a human-readable reason
+	messageControl   messageType = 4 // payload is a JSON ControlMessage
+)
+
+func (t messageType) String() string {
+	switch t {
+	case messageData:
+		return "data"
+	case messageKeepalive:
+		return "keepalive"
+	case messageClose:
+		return "close"
+	case messageControl:
+		return "control"
+	}
+	return fmt.Sprintf("type %d", byte(t))
+}
+
+func encodeMessage(t messageType, payload []byte) []byte {
+	message := make([]byte, messageHeaderLen, messageHeaderLen+len(payload))
+	message[0] = messageVersion
+	message[1] = byte(t)
+	return append(message, payload...)
+}
+
+func decodeMessage(message []byte) (messageType, []byte, error) {
+	if len(message) < messageHeaderLen {
+		return 0, nil, errors.New("message too short")
+	}
+	if message[0] != messageVersion {
+		return 0, nil, fmt.Errorf("unsupported message version %d", message[0])
+	}
+	return messageType(message[1]), message[messageHeaderLen:], nil
+}
+
+// ControlMessage is the payload of a control message. Kind selects the
+// handler on the receiving side and Body is handed to it undecoded.
+type ControlMessage struct {
+	Kind string          `json:"kind"`
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// Kinds of control message
+const (
+	controlServerKeys = "server-keys" // body is a ServerKeys
+)
+
+// ServerKeys tells a client which server keys to pin: the key the server
+// uses now and, while a rotation is being prepared, the key it will switch
+// to. Keys are hex encoded.
+type ServerKeys struct {
+	Current string `json:"current"`
+	Next    string `json:"next,omitempty"`
+}
+
+func decodeControl(payload []byte) (*ControlMessage, error) {
+	var control ControlMessage
+	err := json.Unmarshal(payload, &control)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control message: %w", err)
+	}
+	return &control, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// Windows/client/payloads.go
+// Handshake payload encoding for Windows client build
+// Developer: CyberPanther232
+
+// Protocol versions this build speaks. The client offers the newest version
+// it knows and the server answers with the one both sides will use, so a
+// fleet can be upgraded one machine at a time.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// Optional features a peer can offer in its hello. Only features both sides
+// support are turned on for a session.
+const (
+	featureKeepalive  = "keepalive"   // the peer sends keepalives and may be timed out
+	featureServerKeys = "server-keys" // the client follows server key announcements
+)
+
+var supportedFeatures = []string{featureKeepalive, featureServerKeys}
+
+// ClientHello travels in the client's last handshake message, the third with
+// XX and XXpsk3 and the first with IK and IKpsk2, which is encrypted and
+// authenticated by then, and describes what the client can do.
+type ClientHello struct {
+	Version    int      `json:"version"`
+	Name       string   `json:"name,omitempty"`
+	Transports []string `json:"transports,omitempty"`
+	Ciphers    []string `json:"ciphers,omitempty"`
+	MTU        int      `json:"mtu,omitempty"`
+	Features   []string `json:"features,omitempty"`
+
+	// Certificate from a CA the server trusts, for clients that are not in
+	// its authorized peers list
+	Certificate json.RawMessage `json:"certificate,omitempty"`
+
+	// TAI64N time of the handshake, newer than any before it from this
+	// client, so a recorded handshake cannot be replayed
+	Timestamp []byte `json:"timestamp,omitempty"`
+}
+
+func encodeClientHello(hello *ClientHello) ([]byte, error) {
+	return json.Marshal(hello)
+}
+
+// ServerReply is sent by the server once it knows who the client is. It
+// carries the interface configuration the client should apply and the
+// outcome of the negotiation.
+type ServerReply struct {
+	Address   string   `json:"address"`
+	PrefixLen int      `json:"prefix_len"`
+	Gateway   string   `json:"gateway"`
+	Version   int      `json:"version,omitempty"`
+	MTU       int      `json:"mtu,omitempty"`
+	Features  []string `json:"features,omitempty"`
+}
+
+func decodeServerReply(data []byte) (*ServerReply, error) {
+	var reply ServerReply
+	err := json.Unmarshal(data, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("malformed server reply: %w", err)
+	}
+	return &reply, nil
+}
+
+// InterfacePrefix returns the assigned address with its prefix length.
+func (r *ServerReply) InterfacePrefix() (netip.Prefix, error) {
+	addr, err := netip.ParseAddr(r.Address)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid assigned address: %w", err)
+	}
+	prefix := netip.PrefixFrom(addr, r.PrefixLen)
+	if !prefix.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("invalid assigned prefix length %d", r.PrefixLen)
+	}
+	return prefix, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Windows/client/tai64n.go
+// TAI64N handshake timestamps for Windows client build
+// Developer: CyberPanther232
+
+// A tai64n timestamp is 8 bytes of TAI64 seconds followed by 4 bytes of
+// nanoseconds, both big-endian, so timestamps compare like byte strings. The
+// client puts one in every handshake and the server refuses any that is not
+// newer than the last one it saw from the same key, which makes a recorded
+// handshake useless for replays.
+const tai64nLen = 12
+
+type tai64n [tai64nLen]byte
+
+const (
+	// TAI64 label of the Unix epoch, counting the 10 seconds TAI was ahead
+	// of UTC in 1970
+	tai64Base = uint64(0x400000000000000a)
+
+	// Nanoseconds are rounded down to about 16ms, so the timestamp does not
+	// reveal the client's clock to more precision than replays need
+	tai64nWhitener = uint32(0x1000000 - 1)
+)
+
+func tai64nFromTime(t time.Time) tai64n {
+	var ts tai64n
+	binary.BigEndian.PutUint64(ts[:8], tai64Base+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(ts[8:], uint32(t.Nanosecond())&^tai64nWhitener)
+	return ts
+}
+
+// After reports whether ts is strictly later than other.
+func (ts tai64n) After(other tai64n) bool {
+	return bytes.Compare(ts[:], other[:]) > 0
+}
+
+// next returns a timestamp for a new handshake that is later than the
+// previous one even if the clock has not moved on or went back.
+func (ts tai64n) next(now time.Time) tai64n {
+	current := tai64nFromTime(now)
+	if current.After(ts) {
+		return current
+	}
+	// Step the nanoseconds past the whitened resolution
+	binary.BigEndian.PutUint32(ts[8:], binary.BigEndian.Uint32(ts[8:])+tai64nWhitener+1)
+	if binary.BigEndian.Uint32(ts[8:]) >= uint32(time.Second) {
+		binary.BigEndian.PutUint64(ts[:8], binary.BigEndian.Uint64(ts[:8])+1)
+		binary.BigEndian.PutUint32(ts[8:], 0)
+	}
+	return ts
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Windows/client/udp.go
+// UDP transport for Windows client build
+// Developer: CyberPanther232
+
+const maxDatagramSize = 65535
+
+// datagramTransport sends each message as a single datagram, so no framing is
+// needed and a lost message never stalls the ones behind it.
+type datagramTransport struct {
+	conn net.Conn
+}
+
+func dialUDP(address string) (Transport, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramTransport{conn: conn}, nil
+}
+
+func (t *datagramTransport) Send(message []byte) error {
+	_, err := t.conn.Write(message)
+	return err
+}
+
+func (t *datagramTransport) Receive() ([]byte, error) {
+	buf := make([]byte, maxDatagramSize)
+	n, err := t.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (t *datagramTransport) Close() error                  { return t.conn.Close() }
+func (t *datagramTransport) RemoteAddr() net.Addr          { return t.conn.RemoteAddr() }
+func (t *datagramTransport) SetDeadline(d time.Time) error { return t.conn.SetDeadline(d) }
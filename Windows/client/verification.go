@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Windows/client/verification.go
+// Session verification codes for Windows client build
+// Developer: CyberPanther232
+
+// A verification code is a short authentication string derived from the
+// handshake hash, which both ends of a session share only if nobody sat in
+// the middle of the handshake. Reading the codes to each other over another
+// channel, such as a phone call, proves that without any key having been
+// pinned or certified. The code is 32 bits, shown both as four words and as
+// ten digits, so either form can be compared.
+const verificationContext = "burrow verification code\x00"
+
+const verificationWordCount = 4
+
+func verificationCode(channelBinding []byte) string {
+	sum := sha256.Sum256(append([]byte(verificationContext), channelBinding...))
+	words := make([]string, verificationWordCount)
+	for i := range words {
+		words[i] = verificationWords[sum[i]]
+	}
+	digits := fmt.Sprintf("%010d", binary.BigEndian.Uint32(sum[:verificationWordCount]))
+	return fmt.Sprintf("%s (%s %s)", strings.Join(words, " "), digits[:5], digits[5:])
+}
+
+// verificationWords are short, common words that are hard to mishear.
+var verificationWords = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alley",
+	"amber", "angle", "ankle", "apple", "april", "apron", "arena", "armor",
+	"arrow", "atlas", "attic", "audio", "autumn", "axis", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banjo", "barn", "basil", "basket", "beach",
+	"beaver", "bench", "berry", "bishop", "blade", "blanket", "blossom", "boat",
+	"bonus", "border", "bottle", "boxer", "bracket", "brain", "bread", "brick",
+	"bridge", "broom", "bubble", "bucket", "buffalo", "bugle", "butter", "cabin",
+	"cactus", "camel", "camera", "canal", "candle", "canoe", "canyon", "captain",
+	"carbon", "carpet", "castle", "cedar", "cello", "chalk", "cherry", "chess",
+	"chimney", "circus", "cobalt", "cocoa", "comet", "copper", "coral", "cotton",
+	"cousin", "coyote", "crane", "crayon", "cricket", "crystal", "curtain", "cycle",
+	"dagger", "daisy", "dancer", "delta", "denim", "desert", "diamond", "dinner",
+	"doctor", "dolphin", "domino", "donkey", "dragon", "drum", "eagle", "easel",
+	"echo", "eclipse", "elbow", "ember", "engine", "falcon", "feather", "fence",
+	"ferry", "fiddle", "flame", "flute", "forest", "fossil", "fountain", "fox",
+	"galaxy", "garden", "garlic", "gazelle", "ginger", "glacier", "globe", "goblet",
+	"gopher", "granite", "grape", "gravel", "guitar", "hammer", "harbor", "harvest",
+	"hazel", "helmet", "hermit", "honey", "hornet", "hotel", "husky", "igloo",
+	"insect", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw",
+	"jungle", "kayak", "kernel", "kettle", "kitten", "koala", "ladder", "lagoon",
+	"lantern", "laser", "lemon", "lentil", "lizard", "lobster", "locket", "lotus",
+	"magnet", "mango", "maple", "marble", "meadow", "melon", "meteor", "mirror",
+	"mitten", "monkey", "mosaic", "muffin", "napkin", "nectar", "needle", "nickel",
+	"noodle", "nutmeg", "oasis", "ocean", "olive", "onion", "orbit", "orchid",
+	"otter", "oyster", "paddle", "palace", "panda", "parrot", "peanut", "pebble",
+	"pepper", "piano", "pickle", "pillow", "pirate", "planet", "pocket", "polar",
+	"potato", "pumpkin", "puzzle", "quartz", "rabbit", "radar", "raven", "ribbon",
+	"rocket", "saddle", "salmon", "sandal", "scarf", "shovel", "silver", "sparrow",
+	"spider", "sponge", "squid", "statue", "summit", "tablet", "thunder", "tiger",
+	"timber", "toast", "tomato", "torch", "tractor", "trumpet", "tulip", "turtle",
+	"tuxedo", "unicorn", "valley", "velvet", "violin", "volcano", "waffle", "walnut",
+	"walrus", "wagon", "window", "wizard", "yacht", "yogurt", "zebra", "zipper",
+}
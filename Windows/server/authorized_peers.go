@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Windows/server/authorized_peers.go
+// Client authorization list for Windows server build
+// Developer: CyberPanther232
+
+// AuthorizedPeer is one entry of the authorized peers file. AllowedAddresses
+// are extra prefixes routed to the peer on top of its leased address.
+type AuthorizedPeer struct {
+	Name             string   `yaml:"Name"`
+	PublicKey        string   `yaml:"PublicKey"`
+	AllowedAddresses []string `yaml:"AllowedAddresses"`
+	Enabled          *bool    `yaml:"Enabled"`
+	Groups           []string `yaml:"Groups"`
+
+	// Overrides the server-wide PresharedKeyFile for this peer
+	PresharedKeyFile string `yaml:"PresharedKeyFile"`
+
+	allowed []netip.Prefix
+}
+
+func (p *AuthorizedPeer) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+type AuthorizedPeers struct {
+	peers map[string]*AuthorizedPeer // keyed by hex public key
+}
+
+// loadAuthorizedPeers reads the authorized peers file. If optional is set, as
+// it is when certificates can admit clients, a missing file is an empty list.
+func loadAuthorizedPeers(path string, optional bool) (*AuthorizedPeers, error) {
+	data, err := os.ReadFile(path)
+	if optional && errors.Is(err, os.ErrNotExist) {
+		return &AuthorizedPeers{peers: make(map[string]*AuthorizedPeer)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*AuthorizedPeer
+	err = yaml.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse authorized peers file: %w", err)
+	}
+
+	authorized := &AuthorizedPeers{peers: make(map[string]*AuthorizedPeer)}
+	for i, peer := range entries {
+		key, err := parsePublicKey(peer.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %d (%s): %w", i+1, peer.Name, err)
+		}
+		err = peer.parseAllowed()
+		if err != nil {
+			return nil, fmt.Errorf("peer %d (%s): %w", i+1, peer.Name, err)
+		}
+		authorized.peers[hex.EncodeToString(key)] = peer
+	}
+	return authorized, nil
+}
+
+// peerFromCertificate builds the entry for a client admitted by a certificate
+// instead of the authorized peers file.
+func peerFromCertificate(cert *Certificate) (*AuthorizedPeer, error) {
+	peer := &AuthorizedPeer{
+		Name:             cert.Name,
+		PublicKey:        cert.PublicKey,
+		AllowedAddresses: cert.AllowedAddresses,
+		Groups:           cert.Groups,
+	}
+	err := peer.parseAllowed()
+	if err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+func (p *AuthorizedPeer) parseAllowed() error {
+	for _, s := range p.AllowedAddresses {
+		prefix, err := parsePrefixOrAddr(s)
+		if err != nil {
+			return fmt.Errorf("invalid allowed address %q: %w", s, err)
+		}
+		p.allowed = append(p.allowed, prefix)
+	}
+	return nil
+}
+
+// Lookup returns the entry for a client static key. Disabled peers are
+// reported as found so the caller can log why the client was refused.
+func (a *AuthorizedPeers) Lookup(key []byte) (*AuthorizedPeer, bool) {
+	peer, ok := a.peers[hex.EncodeToString(key)]
+	return peer, ok
+}
+
+// PresharedKeyFiles lists the distinct per-peer pre-shared key files.
+func (a *AuthorizedPeers) PresharedKeyFiles() []string {
+	var paths []string
+	for _, peer := range a.peers {
+		if peer.PresharedKeyFile != "" && !slices.Contains(paths, peer.PresharedKeyFile) {
+			paths = append(paths, peer.PresharedKeyFile)
+		}
+	}
+	return paths
+}
+
+// AllowedPrefixes lists the AllowedAddresses of every peer.
+func (a *AuthorizedPeers) AllowedPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, peer := range a.peers {
+		prefixes = append(prefixes, peer.allowed...)
+	}
+	return prefixes
+}
+
+func (a *AuthorizedPeers) Count() int {
+	return len(a.peers)
+}
+
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return hostPrefix(addr), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Windows/server/certificate.go
+// Peer certificates for Windows server build
+// Developer: CyberPanther232
+
+// A peer certificate lets a Burrow CA vouch for a client's static key, so a
+// server only needs the CA's public key instead of a list of every client.
+// The signed body is kept as the exact bytes that were signed, which spares
+// both sides from agreeing on a canonical encoding.
+const certificateVersion = 1
+
+const defaultCertificateValidity = 90 * 24 * time.Hour
+
+// certificateContext is prepended to the body before signing, so a CA key
+// cannot be tricked into signing anything that verifies as a certificate.
+const certificateContext = "burrow peer certificate\x00"
+
+// Certificate binds a client's Noise static key to the name, addresses and
+// groups the server should give it, for a limited time.
+type Certificate struct {
+	Version          int       `json:"version"`
+	PublicKey        string    `json:"public_key"` // hex client static key
+	Name             string    `json:"name"`
+	AllowedAddresses []string  `json:"allowed_addresses,omitempty"`
+	Groups           []string  `json:"groups,omitempty"`
+	NotBefore        time.Time `json:"not_before"`
+	NotAfter         time.Time `json:"not_after"`
+}
+
+// SignedCertificate is the form a certificate is stored and sent in.
+type SignedCertificate struct {
+	Body      []byte `json:"certificate"`
+	Signature []byte `json:"signature"`
+}
+
+func signCertificate(cert *Certificate, ca ed25519.PrivateKey) ([]byte, error) {
+	body, err := json.Marshal(cert)
+	if err != nil {
+		return nil, err
+	}
+	signature := ed25519.Sign(ca, append([]byte(certificateContext), body...))
+	return json.MarshalIndent(&SignedCertificate{Body: body, Signature: signature}, "", "  ")
+}
+
+// parseCertificate decodes a signed certificate without checking it.
+func parseCertificate(data []byte) (*SignedCertificate, *Certificate, error) {
+	var signed SignedCertificate
+	err := json.Unmarshal(data, &signed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	var cert Certificate
+	err = json.Unmarshal(signed.Body, &cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	if cert.Version != certificateVersion {
+		return nil, nil, fmt.Errorf("unsupported certificate version %d", cert.Version)
+	}
+	return &signed, &cert, nil
+}
+
+// verifyCertificate checks that a certificate was signed by one of the
+// trusted CA keys, is issued for peerStatic and is valid at now.
+func verifyCertificate(data []byte, cas []ed25519.PublicKey, peerStatic []byte, now time.Time) (*Certificate, error) {
+	signed, cert, err := parseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	message := append([]byte(certificateContext), signed.Body...)
+	trusted := false
+	for _, ca := range cas {
+		if ed25519.Verify(ca, message, signed.Signature) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return nil, errors.New("certificate is not signed by a trusted CA")
+	}
+
+	key, err := parsePublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate key: %w", err)
+	}
+	if !bytes.Equal(key, peerStatic) {
+		return nil, errors.New("certificate is issued for a different key")
+	}
+	if now.Before(cert.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return cert, nil
+}
+
+// loadCertificate reads a certificate file and checks that it is issued for
+// the given key, so a client notices a mismatch before connecting.
+func loadCertificate(path string, publicKey []byte) ([]byte, *Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, cert, err := parseCertificate(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate key: %w", err)
+	}
+	if !bytes.Equal(key, publicKey) {
+		return nil, nil, fmt.Errorf("certificate is issued for %s, not for this key", fingerprint(key))
+	}
+	return data, cert, nil
+}
+
+// CA keys are stored like private key files, as the 32-byte Ed25519 seed.
+func generateCAKey() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	return priv, err
+}
+
+func loadCAKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid CA key length")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
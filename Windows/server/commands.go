@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Windows/server/commands.go
+// Key management subcommands for Windows server build
+// Developer: CyberPanther232
+
+// runCommand handles the subcommands that manage key files instead of
+// starting the server, and returns the process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "genpsk":
+		key, err := generatePresharedKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate pre-shared key: %v\n", err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	case "rotatepsk":
+		if len(args) != 2 && len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: rotatepsk <key file> [key]")
+			return 2
+		}
+		var key string
+		if len(args) == 3 {
+			key = args[2]
+		}
+		// The server learns a new key before it uses it, so it goes below
+		// the key in use until that one is removed
+		key, err := rotatePresharedKey(args[1], key, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate pre-shared key: %v\n", err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	case "encryptkey", "decryptkey":
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s <private key file>\n", args[0])
+			return 2
+		}
+		err := convertKeyFile(args[1], args[0] == "encryptkey")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update %s: %v\n", args[1], err)
+			return 1
+		}
+		return 0
+	case "genkey", "pubkey", "fingerprint", "nextkey", "rotate":
+		if len(args) > 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s [private key file]\n", args[0])
+			return 2
+		}
+		path, encrypt, err := keyFileFromArgs(args)
+		if err == nil {
+			err = runKeyCommand(args[0], path, encrypt)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+			return 1
+		}
+		return 0
+	case "cagenkey", "signcert", "showcert", "revoke":
+		err := runCertCommand(args[0], args[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return 2
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q (available: genkey, pubkey, fingerprint, nextkey, rotate, genpsk, rotatepsk, encryptkey, decryptkey, cagenkey, signcert, showcert, revoke)\n", args[0])
+	return 2
+}
+
+// keyFileFromArgs returns the private key file named on the command line or,
+// without one, PrivateKeyFile from the configuration, and whether new keys
+// are to be encrypted.
+func keyFileFromArgs(args []string) (string, bool, error) {
+	config, err := loadServerConfig("server_config.yml")
+	if len(args) == 2 {
+		return args[1], err == nil && config.EncryptPrivateKey, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("no key file given and server_config.yml could not be loaded: %w", err)
+	}
+	return config.PrivateKeyFile, config.EncryptPrivateKey, nil
+}
+
+func runKeyCommand(command, path string, encrypt bool) error {
+	switch command {
+	case "genkey":
+		if fileExists(path) {
+			return fmt.Errorf("%s already exists; use rotate to replace it", path)
+		}
+		key, err := generateIdentity()
+		if err != nil {
+			return err
+		}
+		err = saveKey(path, key, encrypt)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%x\n", key.Public)
+	case "pubkey", "fingerprint":
+		key, err := loadKey(path)
+		if err != nil {
+			return err
+		}
+		if command == "pubkey" {
+			fmt.Printf("%x\n", key.Public)
+		} else {
+			fmt.Println(fingerprint(key.Public))
+		}
+	case "nextkey":
+		key, err := prepareNextKey(path, encrypt)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Next key stored in %s; a running server announces it within seconds, then rotate once clients have it\n", nextKeyPath(path))
+		fmt.Printf("%x\n", key.Public)
+	case "rotate":
+		key, err := rotateKeyFile(path, encrypt)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Previous key kept in %s; restart the server to accept both\n", previousKeyPath(path))
+		fmt.Printf("%x\n", key.Public)
+	}
+	return nil
+}
+
+// runCertCommand creates CA keys, issues and inspects peer certificates and
+// revokes client keys.
+func runCertCommand(command string, args []string) error {
+	switch command {
+	case "cagenkey":
+		path := "ca.key"
+		if len(args) > 1 {
+			fmt.Fprintln(os.Stderr, "usage: cagenkey [CA key file]")
+			return flag.ErrHelp
+		}
+		if len(args) == 1 {
+			path = args[0]
+		}
+		if fileExists(path) {
+			return fmt.Errorf("%s already exists", path)
+		}
+		key, err := generateCAKey()
+		if err != nil {
+			return err
+		}
+		config, err := loadServerConfig("server_config.yml")
+		err = writeKeyFile(path, key.Seed(), err == nil && config.EncryptPrivateKey)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "CA key stored in %s; add its public key to CAPublicKeys\n", path)
+		fmt.Printf("%x\n", key.Public())
+	case "signcert":
+		flags := flag.NewFlagSet("signcert", flag.ContinueOnError)
+		caPath := flags.String("ca", "ca.key", "CA key file")
+		publicKey := flags.String("key", "", "client public key, hex or base64")
+		name := flags.String("name", "", "client name")
+		allowed := flags.String("allow", "", "comma-separated extra prefixes routed to the client")
+		groups := flags.String("groups", "", "comma-separated groups")
+		valid := flags.Duration("valid", defaultCertificateValidity, "how long the certificate is valid")
+		out := flags.String("out", "", "certificate file (default <name>.cert)")
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		}
+		key, err := parsePublicKey(*publicKey)
+		if err != nil {
+			return err
+		}
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+		if *out == "" {
+			*out = *name + ".cert"
+		}
+
+		cert := &Certificate{
+			Version:          certificateVersion,
+			PublicKey:        hex.EncodeToString(key),
+			Name:             *name,
+			AllowedAddresses: splitList(*allowed),
+			Groups:           splitList(*groups),
+			NotBefore:        time.Now().UTC().Truncate(time.Second),
+		}
+		cert.NotAfter = cert.NotBefore.Add(*valid)
+		_, err = peerFromCertificate(cert)
+		if err != nil {
+			return err
+		}
+		ca, err := loadCAKey(*caPath)
+		if err != nil {
+			return err
+		}
+		data, err := signCertificate(cert, ca)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(*out, data, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Certificate for %q (%s) valid until %s written to %s\n", cert.Name, fingerprint(key), cert.NotAfter.Format(time.RFC3339), *out)
+	case "showcert":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: showcert <certificate file>")
+			return flag.ErrHelp
+		}
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		_, cert, err := parseCertificate(data)
+		if err != nil {
+			return err
+		}
+		key, err := parsePublicKey(cert.PublicKey)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Name:              %s\n", cert.Name)
+		fmt.Printf("Public key:        %x (%s)\n", key, fingerprint(key))
+		fmt.Printf("Allowed addresses: %v\n", cert.AllowedAddresses)
+		fmt.Printf("Groups:            %v\n", cert.Groups)
+		fmt.Printf("Valid:             %s to %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	case "revoke":
+		flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+		caPath := flags.String("ca", "ca.key", "CA key file")
+		listPath := flags.String("list", "", "revocation list (default RevokedKeysFile from server_config.yml)")
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "usage: revoke [-ca CA key file] [-list revocation list] <key fingerprint or public key>...")
+			return flag.ErrHelp
+		}
+		if *listPath == "" {
+			config, err := loadServerConfig("server_config.yml")
+			if err != nil || config.RevokedKeysFile == "" {
+				return errors.New("no -list given and no RevokedKeysFile in server_config.yml")
+			}
+			*listPath = config.RevokedKeysFile
+		}
+		ca, err := loadCAKey(*caPath)
+		if err != nil {
+			return err
+		}
+		list, err := revokeKeys(*listPath, ca, flags.Args())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revocation list %d with %d revoked keys written to %s\n", list.Serial, len(list.Revoked), *listPath)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// convertKeyFile rewrites a private key file encrypted with a new passphrase,
+// or in the clear.
+func convertKeyFile(path string, encrypt bool) error {
+	priv, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	if len(priv) != 32 {
+		return errors.New("invalid private key length")
+	}
+	return writeKeyFile(path, priv, encrypt)
+}
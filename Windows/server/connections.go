@@ -1,62 +1,305 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"log"
-	"net"
-
-	"github.com/flynn/noise"
-	"golang.zx2c4.com/wireguard/tun"
+	"net/netip"
+	"os"
+	"slices"
 )
 
 // Windows/server/connections.go
 // Connection handling functions for Windows server build
 // Developer: CyberPanther232
 
-func startListener(dev tun.Device, conn net.Conn, recvCipher *noise.CipherState) {
+func (srv *Server) acceptLoop(listener TransportListener) {
 	for {
-		ciphertext, err := readFramed(conn)
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Listener: Error reading from TCP: %v", err)
+			log.Printf("Accept: Listener closed: %v", err)
 			return
 		}
-		log.Printf("Listener: Received %d bytes from %s\n", len(ciphertext), conn.RemoteAddr().String())
+		log.Printf("Client connected from %s\n", conn.RemoteAddr())
+
+		go srv.serveConnection(conn)
+	}
+}
+
+func (srv *Server) serveConnection(conn Transport) {
+	var peerKey []byte
+	var peer *AuthorizedPeer
+	var address netip.Addr
+	var features []string
 
-		decryptedPacket, err := decryptPacket(recvCipher, ciphertext)
+	send, recv, channelBinding, err := runServerHandshake(conn, srv.keys.Load().keys, srv.handshakeOptions(), func(mode handshakeMode, peerStatic, helloPayload []byte) ([]byte, error) {
+		hello, err := decodeClientHello(helloPayload)
 		if err != nil {
-			log.Fatalf("Listener: Failed to decrypt packet: %v", err)
+			return nil, err
 		}
-		log.Printf("Listener: Decrypted packet: %d bytes\n", len(decryptedPacket))
+		authorized, err := srv.authorizePeer(peerStatic, hello, mode, conn.RemoteAddr())
+		if err != nil {
+			return nil, err
+		}
+		err = srv.timestamps.Check(peerStatic, hello.Timestamp)
+		if err != nil {
+			log.Printf("Refused client %q (%s) from %s: %v\n", authorized.Name, fingerprint(peerStatic), conn.RemoteAddr(), err)
+			return nil, err
+		}
+		peerKey = peerStatic
+		peer = authorized
 
-		_, err = dev.Write([][]byte{decryptedPacket}, 4)
+		version, err := negotiateVersion(hello.Version)
 		if err != nil {
-			log.Printf("Listener: Error writing to TUN device: %v", err)
+			return nil, err
+		}
+		mtu := srv.config.MTU
+		if hello.MTU > 0 {
+			mtu = min(mtu, hello.MTU)
 		}
+		features = negotiateFeatures(hello.Features)
+		log.Printf("Client %q reports name %q, protocol %d, transports %v, cipher suites %v, features %v\n", authorized.Name, hello.Name, version, hello.Transports, hello.Ciphers, features)
+
+		leased, err := srv.pool.Acquire(peerStatic)
+		if err != nil {
+			return nil, err
+		}
+		address = leased
+		// A peer admitted by certificate may route the address already
+		if owner, ok := srv.routes.Owner(hostPrefix(address)); ok && !bytes.Equal(owner.PeerKey, peerStatic) {
+			log.Printf("Refused client %q: its address %s is routed to client %q\n", peer.Name, address, owner.Name)
+			return nil, errors.New("leased address is routed to another client")
+		}
+		log.Printf("Leased %s to client %q\n", address, peer.Name)
+
+		return encodeServerReply(&ServerReply{
+			Address:   address.String(),
+			PrefixLen: srv.pool.Prefix().Bits(),
+			Gateway:   srv.pool.Gateway().String(),
+			Version:   version,
+			MTU:       mtu,
+			Features:  features,
+		})
+	})
+	if errors.Is(err, errHandshakeThrottled) {
+		conn.Close()
+		return
+	}
+	if err != nil {
+		log.Printf("Handshake with %s failed: %v", conn.RemoteAddr(), err)
+		if address.IsValid() {
+			srv.pool.Release(peerKey)
+		}
+		conn.Close()
+		return
+	}
+
+	send.policy = newRekeyPolicy(srv.config.RekeyInterval, srv.config.RekeyBytes)
+	// Clients that never send keepalives cannot be told apart from dead ones
+	timeout := srv.config.PeerTimeout
+	if !slices.Contains(features, featureKeepalive) {
+		timeout = 0
 	}
+	monitor := newPeerMonitor(srv.config.KeepaliveInterval, timeout)
+	session := newSession(conn, send, recv, monitor)
+	session.Name = peer.Name
+	session.PeerKey = peerKey
+	session.Groups = peer.Groups
+	session.Address = address
+	session.Features = features
+	srv.sessions.Add(session)
+	// The revocation list may have changed while the handshake ran
+	if srv.isRevoked(peerKey) {
+		log.Printf("Session %d: Client key %s was revoked during the handshake, closing\n", session.ID, fingerprint(peerKey))
+		session.Disconnect("client key revoked")
+		srv.pool.Release(peerKey)
+		srv.sessions.Remove(session)
+		return
+	}
+
+	// A returning client takes over its address from its own stale session,
+	// never from a peer whose allowed addresses merely cover it
+	if stale, ok := srv.routes.Owner(hostPrefix(address)); ok && bytes.Equal(stale.PeerKey, peerKey) {
+		log.Printf("Session %d: Replaced by a new session from the same client\n", stale.ID)
+		srv.routes.RemoveSession(stale)
+		stale.Close()
+	}
+	if !srv.routes.Add(hostPrefix(address), session) {
+		log.Printf("Session %d: Address %s was routed to another session during the handshake, closing\n", session.ID, address)
+		session.Disconnect("address in use")
+		srv.pool.Release(peerKey)
+		srv.sessions.Remove(session)
+		return
+	}
+	for _, prefix := range peer.allowed {
+		if !srv.routes.Add(prefix, session) {
+			log.Printf("Session %d: Allowed address %s is already routed to another session\n", session.ID, prefix)
+		}
+	}
+	log.Printf("Session %d: Established with %q at %s as %s (%d active)\n", session.ID, session.Name, session.RemoteAddr(), address, srv.sessions.Count())
+	log.Printf("Session %d: Verification code %s\n", session.ID, verificationCode(channelBinding))
+
+	// Keep the idle session alive; a peer silent for too long is gone
+	go monitor.Run(session.Done(), func() error {
+		return session.SendMessage(messageKeepalive, nil)
+	}, func() {
+		log.Printf("Session %d: No traffic from peer for %s, closing\n", session.ID, timeout)
+		session.Close()
+	})
+
+	if slices.Contains(features, featureServerKeys) {
+		err = srv.announceKeys(session)
+		if err != nil {
+			log.Printf("Session %d: Failed to announce server keys: %v\n", session.ID, err)
+		}
+	}
+
+	srv.startListener(session)
+
+	srv.routes.RemoveSession(session)
+	srv.pool.Release(session.PeerKey)
+	srv.sessions.Remove(session)
+	log.Printf("Session %d: Closed (%d active)\n", session.ID, srv.sessions.Count())
 }
 
-func handleConnections(dev tun.Device, conn net.Conn, sendCipher *noise.CipherState) {
-	packets := make([][]byte, 1)
-	packets[0] = make([]byte, 1500) // Standard MTU size
-	sizes := make([]int, 1)
+func (srv *Server) startListener(session *Session) {
+	for {
+		ciphertext, err := session.conn.Receive()
+		if err != nil {
+			log.Printf("Listener: Error reading from %s: %v", session.RemoteAddr(), err)
+			return
+		}
+		log.Printf("Listener: Received %d bytes from %s\n", len(ciphertext), session.RemoteAddr())
+
+		// Forged, corrupted or replayed packets are dropped, not fatal
+		decryptedPacket, err := decryptPacket(session.recv, ciphertext)
+		if err != nil {
+			log.Printf("Listener: Dropping packet from session %d: %v", session.ID, err)
+			continue
+		}
+		session.monitor.Received()
+
+		msgType, payload, err := decodeMessage(decryptedPacket)
+		if err != nil {
+			log.Printf("Listener: Dropping packet from session %d: %v", session.ID, err)
+			continue
+		}
+
+		switch msgType {
+		case messageData:
+			srv.handleData(session, payload)
+		case messageKeepalive:
+			log.Printf("Listener: Keepalive from session %d\n", session.ID)
+		case messageClose:
+			log.Printf("Session %d: Closed by peer: %s\n", session.ID, payload)
+			return
+		case messageControl:
+			srv.handleControl(session, payload)
+		default:
+			log.Printf("Listener: Dropping unknown %s message from session %d", msgType, session.ID)
+		}
+	}
+}
+
+// handleData writes an IP packet from a session into the TUN device.
+func (srv *Server) handleData(session *Session, packet []byte) {
+	log.Printf("Listener: Decrypted packet: %d bytes\n", len(packet))
+
+	// Only accept packets sourced from addresses routed to this peer
+	src, ok := packetSource(packet)
+	if !ok {
+		log.Printf("Listener: Dropping non-IP packet from session %d", session.ID)
+		return
+	}
+	if owner, ok := srv.routes.Lookup(src); !ok || owner != session {
+		log.Printf("Listener: Dropping packet from session %d with spoofed source %s", session.ID, src)
+		return
+	}
+
+	err := srv.writeTUN(packet)
+	if err != nil {
+		log.Printf("Listener: Error writing to TUN device: %v", err)
+	}
+}
+
+// handleControl routes a control message to the handler registered for its
+// kind. Control messages never reach the TUN device.
+func (srv *Server) handleControl(session *Session, payload []byte) {
+	control, err := decodeControl(payload)
+	if err != nil {
+		log.Printf("Listener: Dropping control message from session %d: %v", session.ID, err)
+		return
+	}
+	handler, ok := srv.control[control.Kind]
+	if !ok {
+		log.Printf("Listener: Ignoring unknown control message %q from session %d", control.Kind, session.ID)
+		return
+	}
+	err = handler(session, control.Body)
+	if err != nil {
+		log.Printf("Listener: Control message %q from session %d failed: %v", control.Kind, session.ID, err)
+	}
+}
+
+func (srv *Server) handleConnections() {
+	batch := srv.dev.BatchSize()
+	packets := make([][]byte, batch)
+	for i := range packets {
+		packets[i] = make([]byte, tunBufferSize)
+	}
+	sizes := make([]int, batch)
 
 	for {
-		n, err := dev.Read(packets, sizes, 0)
+		n, err := srv.dev.Read(packets, sizes, tunOffset)
+		if errors.Is(err, os.ErrClosed) {
+			log.Printf("Handler: TUN device closed\n")
+			return
+		}
+		// A failed read, such as an offload packet with more segments than
+		// the batch holds, only loses those packets
 		if err != nil {
 			log.Printf("Handler: Read error: %v\n", err)
-			break
 		}
 
 		for i := 0; i < n; i++ {
-			packetData := packets[i][:sizes[i]]
+			packetData := packets[i][tunOffset : tunOffset+sizes[i]]
 			log.Printf("Handler: Captured packet: %d bytes\n", len(packetData))
 
-			encryptedPacket := encryptPacket(sendCipher, packetData)
-			log.Printf("Handler: Encrypted packet: %d bytes\n", len(encryptedPacket))
+			dst, ok := packetDestination(packetData)
+			if !ok {
+				log.Printf("Handler: Dropping non-IP packet")
+				continue
+			}
+
+			session, ok := srv.routes.Lookup(dst)
+			if !ok {
+				srv.handleUnroutable(packetData, dst)
+				continue
+			}
 
-			err = sendFramed(conn, encryptedPacket)
+			err = session.Send(packetData)
 			if err != nil {
-				log.Printf("Handler: Failed to write to TCP: %v", err)
+				log.Printf("Handler: Failed to write to session %d: %v", session.ID, err)
 			}
 		}
 	}
 }
+
+func (srv *Server) handleUnroutable(packet []byte, dst netip.Addr) {
+	if !srv.config.SendUnreachable {
+		log.Printf("Handler: No route to %s, dropping packet", dst)
+		return
+	}
+
+	reply, ok := buildUnreachable(packet, srv.gateway)
+	if !ok {
+		log.Printf("Handler: No route to %s, dropping packet", dst)
+		return
+	}
+	log.Printf("Handler: No route to %s, sending ICMP unreachable", dst)
+
+	err := srv.writeTUN(reply)
+	if err != nil {
+		log.Printf("Handler: Error writing to TUN device: %v", err)
+	}
+}
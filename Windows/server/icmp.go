@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// Windows/server/icmp.go
+// ICMP destination unreachable generation for Windows server build
+// Developer: CyberPanther232
+
+const (
+	icmpv4DestUnreachable = 3
+	icmpv6DestUnreachable = 1
+	icmpNoRoute           = 0
+
+	protoICMPv4 = 1
+	protoICMPv6 = 58
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	icmpHeaderLen = 8
+
+	ipv6MinMTU = 1280
+)
+
+// buildUnreachable answers an unroutable packet with an ICMP or ICMPv6
+// "no route to destination" error sourced from gateway. It returns false when
+// no error should be generated, e.g. for ICMP errors, multicast, or when the
+// server has no address in the packet's family.
+func buildUnreachable(packet []byte, gateway netip.Addr) ([]byte, bool) {
+	switch ipVersion(packet) {
+	case 4:
+		if !gateway.Is4() {
+			return nil, false
+		}
+		return buildUnreachable4(packet, gateway)
+	case 6:
+		if !gateway.Is6() {
+			return nil, false
+		}
+		return buildUnreachable6(packet, gateway)
+	}
+	return nil, false
+}
+
+func buildUnreachable4(packet []byte, gateway netip.Addr) ([]byte, bool) {
+	if len(packet) < ipv4HeaderLen {
+		return nil, false
+	}
+	headerLen := int(packet[0]&0x0f) * 4
+	if headerLen < ipv4HeaderLen || len(packet) < headerLen {
+		return nil, false
+	}
+	// Only answer the first fragment.
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return nil, false
+	}
+	src, _ := packetSource(packet)
+	dst, _ := packetDestination(packet)
+	if !src.IsGlobalUnicast() || dst.IsMulticast() || dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return nil, false
+	}
+	if packet[9] == protoICMPv4 && isICMPError(packet[headerLen:], 4) {
+		return nil, false
+	}
+
+	quoteLen := min(len(packet), headerLen+8)
+	reply := make([]byte, ipv4HeaderLen+icmpHeaderLen+quoteLen)
+
+	ip := reply[:ipv4HeaderLen]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(reply)))
+	ip[8] = 64 // TTL
+	ip[9] = protoICMPv4
+	gw := gateway.As4()
+	copy(ip[12:16], gw[:])
+	copy(ip[16:20], packet[12:16])
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip, 0))
+
+	icmp := reply[ipv4HeaderLen:]
+	icmp[0] = icmpv4DestUnreachable
+	icmp[1] = icmpNoRoute
+	copy(icmp[icmpHeaderLen:], packet[:quoteLen])
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+
+	return reply, true
+}
+
+func buildUnreachable6(packet []byte, gateway netip.Addr) ([]byte, bool) {
+	if len(packet) < ipv6HeaderLen {
+		return nil, false
+	}
+	src, _ := packetSource(packet)
+	dst, _ := packetDestination(packet)
+	if src.IsUnspecified() || src.IsMulticast() || dst.IsMulticast() {
+		return nil, false
+	}
+	if packet[6] == protoICMPv6 && isICMPError(packet[ipv6HeaderLen:], 6) {
+		return nil, false
+	}
+
+	quoteLen := min(len(packet), ipv6MinMTU-ipv6HeaderLen-icmpHeaderLen)
+	reply := make([]byte, ipv6HeaderLen+icmpHeaderLen+quoteLen)
+	payloadLen := icmpHeaderLen + quoteLen
+
+	ip := reply[:ipv6HeaderLen]
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(payloadLen))
+	ip[6] = protoICMPv6
+	ip[7] = 64 // hop limit
+	gw := gateway.As16()
+	copy(ip[8:24], gw[:])
+	copy(ip[24:40], packet[8:24])
+
+	icmp := reply[ipv6HeaderLen:]
+	icmp[0] = icmpv6DestUnreachable
+	icmp[1] = icmpNoRoute
+	copy(icmp[icmpHeaderLen:], packet[:quoteLen])
+
+	// The ICMPv6 checksum covers a pseudo-header of both addresses, the
+	// upper-layer length and the next header value.
+	var pseudo uint32
+	pseudo = sumWords(ip[8:40], pseudo)
+	pseudo += uint32(payloadLen)
+	pseudo += protoICMPv6
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, pseudo))
+
+	return reply, true
+}
+
+// isICMPError reports whether an ICMP message is itself an error, which must
+// never trigger another error in response.
+func isICMPError(message []byte, family int) bool {
+	if len(message) == 0 {
+		return true
+	}
+	if family == 6 {
+		return message[0] < 128
+	}
+	switch message[0] {
+	case 3, 4, 5, 11, 12:
+		return true
+	}
+	return false
+}
+
+func sumWords(data []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+func checksum(data []byte, initial uint32) uint16 {
+	sum := sumWords(data, initial)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -5,20 +5,26 @@ package main
 // Developer: CyberPanther232
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
 	"os"
 	"syscall"
+	"time"
 
-	"os/exec"
 	"os/signal"
 
+	"github.com/flynn/noise"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
 func main() {
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	fmt.Println("Starting Windows VPN Server...")
 
 	config, err := loadServerConfig("server_config.yml")
@@ -26,54 +32,82 @@ func main() {
 		log.Fatalf("Failed to load server configuration: %v", err)
 	}
 
-	fmt.Println("Creating TUN interface...")
-	dev, err := tun.CreateTUN("BurrowNet", 1500)
+	serverKey, err := loadKey(config.PrivateKeyFile)
 	if err != nil {
-		log.Fatalf("Failed to create TUN device: %v", err)
+		// Never replace a key that exists but could not be read
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("Failed to load server key: %v", err)
+		}
+		log.Println("No key file found, generating a new one...")
+		serverKey, err = generateIdentity()
+		if err != nil {
+			log.Fatalf("Failed to generate server identity: %v", err)
+		}
+		err = saveKey(config.PrivateKeyFile, serverKey, config.EncryptPrivateKey)
+		if err != nil {
+			log.Fatalf("Failed to save server key: %v", err)
+		}
+	}
+	log.Printf("Server public key: %x (%s)\n", serverKey.Public, fingerprint(serverKey.Public))
+
+	// A key prepared for the next rotation is accepted right away and
+	// announced to clients, so they have it pinned before the switch. One
+	// prepared later is picked up by watchNextKey
+	serverKeys := []noise.DHKey{serverKey}
+	var nextKey []byte
+	next, ok, err := loadNextKey(config.PrivateKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load next server key: %v", err)
+	}
+	if ok {
+		log.Printf("Announcing next key %x (%s)\n", next.Public, fingerprint(next.Public))
+		serverKeys = append(serverKeys, next)
+		nextKey = next.Public
 	}
-	defer dev.Close()
-
-	// 1. Bring the interface up
-	cmd := exec.Command("netsh", "interface", "ip", "set", "address",
-		"name=BurrowNet", "static", config.Address, "255.255.255.0", "none")
-	cmd.Run()
-	fmt.Println("VPN Interface is UP. Press Ctrl+C to stop.")
 
-	listener, err := net.Listen("tcp", ":"+fmt.Sprint(config.Port))
+	// Clients pinned to the key replaced by the last rotation keep working
+	// until its grace period ends
+	previousKey, expires, ok, err := loadPreviousKey(config.PrivateKeyFile, config.KeyGracePeriod)
 	if err != nil {
-		log.Fatalf("Failed to listen on TCP: %v", err)
+		log.Fatalf("Failed to load previous server key: %v", err)
+	}
+	if ok {
+		log.Printf("Also accepting previous key %x until %s\n", previousKey.Public, expires.Format(time.RFC3339))
+		serverKeys = append(serverKeys, previousKey)
 	}
-	defer listener.Close()
 
-	log.Println("Waiting for a client to connect...")
-	conn, err := listener.Accept()
+	fmt.Println("Creating TUN interface...")
+	dev, err := tun.CreateTUN("BurrowNet", config.MTU)
 	if err != nil {
-		log.Fatalf("Failed to accept connection: %v", err)
+		log.Fatalf("Failed to create TUN device: %v", err)
 	}
-	defer conn.Close()
-	log.Printf("Client connected from %s\n", conn.RemoteAddr())
+	defer dev.Close()
 
-	serverKey, err := loadKey()
+	server, err := newServer(config, dev, serverKeys, nextKey)
 	if err != nil {
-		log.Println("No key file found, generating a new one...")
-		serverKey, err = generateIdentity()
-		if err != nil {
-			log.Fatalf("Failed to generate server identity: %v", err)
-		}
-		err = saveKey(serverKey)
-		if err != nil {
-			log.Fatalf("Failed to save server key: %v", err)
-		}
+		log.Fatalf("Failed to initialize server: %v", err)
 	}
-	log.Printf("Server public key: %x\n", serverKey.Public)
+	defer server.Close()
 
-	sendCipher, recvCipher, err := runServerHandshake(conn, serverKey)
+	// 1. Bring the interface up with the gateway address of the pool
+	configureInterface("BurrowNet", netip.PrefixFrom(server.pool.Gateway(), server.pool.Prefix().Bits()))
+	fmt.Println("VPN Interface is UP. Press Ctrl+C to stop.")
+
+	listener, err := listenTransport(config.Transport, ":"+fmt.Sprint(config.Port), server.guard)
 	if err != nil {
-		log.Fatalf("Handshake failed: %v", err)
+		log.Fatalf("Failed to listen on %s: %v", config.Transport, err)
 	}
+	defer listener.Close()
+	log.Printf("Listening on %s/%s\n", listener.Addr(), config.Transport)
 
-	go startListener(dev, conn, recvCipher)
-	go handleConnections(dev, conn, sendCipher)
+	// 2. Accept clients, each with its own handshake and session
+	go server.handleConnections()
+	go server.watchNextKey()
+	if config.RevokedKeysFile != "" {
+		go server.watchRevocations()
+	}
+	go server.acceptLoop(listener)
+	log.Println("Waiting for clients to connect...")
 
 	// 3. Wait for a termination signal
 	sigChan := make(chan os.Signal, 1)
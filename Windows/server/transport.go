@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+// Windows/server/transport.go
+// Pluggable transports for Windows server build
+// Developer: CyberPanther232
+
+// Transport carries whole messages between the two ends of a tunnel. The
+// handshake and packet loops only ever talk to a Transport, so a new carrier
+// only has to implement this interface and register itself in transports.
+type Transport interface {
+	Send(message []byte) error
+	Receive() ([]byte, error)
+	Close() error
+	RemoteAddr() net.Addr
+	SetDeadline(t time.Time) error
+}
+
+type TransportListener interface {
+	Accept() (Transport, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// A listener is handed the server's handshake guard. TCP has no use for it,
+// as the TCP handshake has already proven the client's address, while UDP
+// asks unproven sources for a cookie before it keeps any state for them.
+type transportKind struct {
+	dial   func(address string) (Transport, error)
+	listen func(address string, guard *handshakeGuard) (TransportListener, error)
+}
+
+var transports = map[string]transportKind{
+	"tcp": {dial: dialTCP, listen: listenTCP},
+	"udp": {dial: dialUDP, listen: listenUDP},
+}
+
+const defaultTransport = "tcp"
+
+func lookupTransport(name string) (transportKind, error) {
+	kind, ok := transports[name]
+	if !ok {
+		return transportKind{}, fmt.Errorf("unknown transport %q (available: %v)", name, transportNames())
+	}
+	return kind, nil
+}
+
+// transportNames lists the registered transports in a stable order.
+func transportNames() []string {
+	names := make([]string, 0, len(transports))
+	for n := range transports {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func dialTransport(name, address string) (Transport, error) {
+	kind, err := lookupTransport(name)
+	if err != nil {
+		return nil, err
+	}
+	return kind.dial(address)
+}
+
+func listenTransport(name, address string, guard *handshakeGuard) (TransportListener, error) {
+	kind, err := lookupTransport(name)
+	if err != nil {
+		return nil, err
+	}
+	return kind.listen(address, guard)
+}
+
+// maxFrameSize bounds a message on a stream, the same as the largest
+// datagram. Nothing Burrow sends comes close, and it keeps a peer from making
+// the receiver allocate whatever the length prefix claims.
+const maxFrameSize = 65535
+
+// streamTransport frames messages on a byte stream with a 4-byte big-endian
+// length prefix.
+type streamTransport struct {
+	conn net.Conn
+}
+
+func dialTCP(address string) (Transport, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &streamTransport{conn: conn}, nil
+}
+
+func (t *streamTransport) Send(message []byte) error {
+	// One Write per frame so concurrent senders never interleave
+	frame := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	copy(frame[4:], message)
+	_, err := t.conn.Write(frame)
+	return err
+}
+
+func (t *streamTransport) Receive() ([]byte, error) {
+	lenBuf := make([]byte, 4)
+	_, err := io.ReadFull(t.conn, lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf)
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the limit of %d", length, maxFrameSize)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(t.conn, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (t *streamTransport) Close() error                  { return t.conn.Close() }
+func (t *streamTransport) RemoteAddr() net.Addr          { return t.conn.RemoteAddr() }
+func (t *streamTransport) SetDeadline(d time.Time) error { return t.conn.SetDeadline(d) }
+
+type streamListener struct {
+	listener net.Listener
+}
+
+func listenTCP(address string, _ *handshakeGuard) (TransportListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &streamListener{listener: listener}, nil
+}
+
+func (l *streamListener) Accept() (Transport, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &streamTransport{conn: conn}, nil
+}
+
+func (l *streamListener) Close() error   { return l.listener.Close() }
+func (l *streamListener) Addr() net.Addr { return l.listener.Addr() }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Windows/server/udp.go
+// UDP transport for Windows server build
+// Developer: CyberPanther232
+
+const (
+	maxDatagramSize = 65535
+	udpPeerBacklog  = 256
+	udpAcceptQueue  = 64
+)
+
+// datagramTransport sends each message as a single datagram, so no framing is
+// needed and a lost message never stalls the ones behind it.
+type datagramTransport struct {
+	conn net.Conn
+}
+
+func dialUDP(address string) (Transport, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramTransport{conn: conn}, nil
+}
+
+func (t *datagramTransport) Send(message []byte) error {
+	_, err := t.conn.Write(message)
+	return err
+}
+
+func (t *datagramTransport) Receive() ([]byte, error) {
+	buf := make([]byte, maxDatagramSize)
+	n, err := t.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (t *datagramTransport) Close() error                  { return t.conn.Close() }
+func (t *datagramTransport) RemoteAddr() net.Addr          { return t.conn.RemoteAddr() }
+func (t *datagramTransport) SetDeadline(d time.Time) error { return t.conn.SetDeadline(d) }
+
+// udpListener demultiplexes a single UDP socket into one connection per
+// remote address, so the accept loop can treat UDP clients like TCP ones.
+type udpListener struct {
+	conn  *net.UDPConn
+	guard *handshakeGuard
+
+	mu     sync.Mutex
+	peers  map[string]*udpPeerConn
+	accept chan *udpPeerConn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func listenUDP(address string, guard *handshakeGuard) (TransportListener, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &udpListener{
+		conn:   conn,
+		guard:  guard,
+		peers:  make(map[string]*udpPeerConn),
+		accept: make(chan *udpPeerConn, udpAcceptQueue),
+		closed: make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (l *udpListener) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+
+		l.mu.Lock()
+		peer, ok := l.peers[addr.String()]
+		l.mu.Unlock()
+		if !ok {
+			// Nothing is kept for a new source that still owes the server
+			// a cookie; the challenge goes out from the shared socket
+			if l.guard != nil {
+				var challenge []byte
+				datagram, challenge = l.guard.Screen(addr, datagram)
+				if challenge != nil {
+					l.conn.WriteToUDP(challenge, addr)
+					continue
+				}
+			}
+
+			peer = newUDPPeerConn(l, addr)
+			l.mu.Lock()
+			select {
+			case l.accept <- peer:
+				l.peers[addr.String()] = peer
+			default:
+				l.mu.Unlock()
+				log.Printf("UDP: Accept queue full, dropping datagram from %s", addr)
+				continue
+			}
+			l.mu.Unlock()
+		}
+
+		peer.deliver(datagram)
+	}
+}
+
+func (l *udpListener) Accept() (Transport, error) {
+	select {
+	case peer := <-l.accept:
+		return &datagramTransport{conn: peer}, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *udpListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *udpListener) remove(peer *udpPeerConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.peers[peer.remote.String()] == peer {
+		delete(l.peers, peer.remote.String())
+	}
+}
+
+// udpPeerConn is the view of the shared UDP socket for a single client. Each
+// Read returns exactly one datagram and each Write sends exactly one.
+type udpPeerConn struct {
+	listener *udpListener
+	remote   *net.UDPAddr
+	incoming chan []byte
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	closed       chan struct{}
+	once         sync.Once
+}
+
+func newUDPPeerConn(l *udpListener, remote *net.UDPAddr) *udpPeerConn {
+	return &udpPeerConn{
+		listener: l,
+		remote:   remote,
+		incoming: make(chan []byte, udpPeerBacklog),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *udpPeerConn) deliver(datagram []byte) {
+	select {
+	case c.incoming <- datagram:
+	default:
+		// Receiver is not keeping up; drop like a full socket buffer would
+	}
+}
+
+func (c *udpPeerConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-c.incoming:
+		return copy(b, datagram), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.listener.closed:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *udpPeerConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.listener.conn.WriteToUDP(b, c.remote)
+}
+
+func (c *udpPeerConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.listener.remove(c)
+	})
+	return nil
+}
+
+func (c *udpPeerConn) LocalAddr() net.Addr  { return c.listener.Addr() }
+func (c *udpPeerConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *udpPeerConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *udpPeerConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *udpPeerConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
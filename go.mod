@@ -5,6 +5,7 @@ go 1.25.6
 require (
 	github.com/flynn/noise v1.1.0
 	golang.org/x/crypto v0.37.0
+	golang.org/x/term v0.31.0
 	golang.zx2c4.com/wireguard v0.0.0-20250521234502-f333402bd9cb
 	gopkg.in/yaml.v3 v3.0.1
 )